@@ -0,0 +1,34 @@
+package metrics
+
+import "time"
+
+// Clocks tell the time and construct Tickers.  Exporters use them in place
+// of the time package so time-dependent behavior may be tested without
+// sleeping.
+type Clock interface {
+	Now() time.Time
+	NewTicker(time.Duration) Ticker
+}
+
+// Tickers deliver ticks on a channel at intervals, like time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock is a Clock backed by the time package.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time { return t.Ticker.C }
@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose time only changes when advanced.
+type fakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	created chan struct{}
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:     time.Unix(1000000000, 0),
+		created: make(chan struct{}, 16),
+	}
+}
+
+// Advance moves the clock forward by d, ticking every ticker whose next tick
+// falls within that time.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		for !t.stopped && !t.next.After(c.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.d)
+		}
+	}
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &fakeTicker{c: make(chan time.Time, 1), clock: c, d: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	c.created <- struct{}{}
+	return t
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+type fakeTicker struct {
+	c       chan time.Time
+	clock   *fakeClock
+	d       time.Duration
+	next    time.Time
+	stopped bool
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Stop() {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	t.stopped = true
+}
+
+func TestSystemClock(t *testing.T) {
+	ticker := SystemClock.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	before := SystemClock.Now()
+	if tick := <-ticker.C(); tick.IsZero() {
+		t.Fatal(tick)
+	}
+	if elapsed := SystemClock.Now().Sub(before); 0 > elapsed {
+		t.Fatal(elapsed)
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	c := newFakeClock()
+	ticker := c.NewTicker(time.Second)
+	c.Advance(999 * time.Millisecond)
+	select {
+	case tick := <-ticker.C():
+		t.Fatal(tick)
+	default:
+	}
+	c.Advance(time.Millisecond)
+	if tick := <-ticker.C(); !tick.Equal(c.Now()) {
+		t.Fatal(tick)
+	}
+}
@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"context"
+	"strings"
+)
+
+// tagsKey is the context key under which WithTags stores tags.
+type tagsKey struct{}
+
+// WithTags returns a copy of ctx carrying the given tags as well as any it
+// inherits from ctx, which those given override.
+func WithTags(ctx context.Context, tags map[string]string) context.Context {
+	merged := TagsFromContext(ctx)
+	if nil == merged {
+		merged = make(map[string]string, len(tags))
+	}
+	for key, value := range tags {
+		merged[key] = value
+	}
+	return context.WithValue(ctx, tagsKey{}, merged)
+}
+
+// TagsFromContext returns a copy of the tags ctx carries, nil if it carries
+// none.
+func TagsFromContext(ctx context.Context) map[string]string {
+	tags, _ := ctx.Value(tagsKey{}).(map[string]string)
+	if nil == tags {
+		return nil
+	}
+	copied := make(map[string]string, len(tags))
+	for key, value := range tags {
+		copied[key] = value
+	}
+	return copied
+}
+
+// TaggedName returns name with tags appended in Graphite's ";key=value" form,
+// sorted by key, which the statsd and Graphite exporters split back out to
+// send them as tags in their configured TagFormat, or as labels appended to
+// the name where it's TagFormatNone.  Characters Graphite can't carry, among
+// them the ';' separating tags, and the ':' and '|' which would break statsd
+// lines are replaced with underscores, so that a value of "a;b" is sent as
+// "a_b", and tags with empty keys or values are left out.
+func TaggedName(name string, tags map[string]string) string {
+	encoded, _ := encodeTags(tags, TagFormatGraphite, false)
+	return name + encoded
+}
+
+// GetOrRegisterTagged is like Registry.GetOrRegister but gets or registers
+// the metric under TaggedName(name, TagsFromContext(ctx)), so that metrics
+// recorded within a request's context carry its tags, such as its route.
+func GetOrRegisterTagged(ctx context.Context, r Registry, name string, i interface{}) interface{} {
+	if nil == r {
+		r = DefaultRegistry
+	}
+	return r.GetOrRegister(TaggedName(name, TagsFromContext(ctx)), i)
+}
+
+// splitTaggedName splits a name returned by TaggedName into the name and
+// tags it was made from, nil if it has none.
+func splitTaggedName(tagged string) (string, map[string]string) {
+	if strings.IndexByte(tagged, ';') < 0 {
+		return tagged, nil
+	}
+	parts := strings.Split(tagged, ";")
+	tags := make(map[string]string, len(parts)-1)
+	for _, part := range parts[1:] {
+		if i := strings.Index(part, "="); 0 <= i {
+			tags[part[:i]] = part[i+1:]
+		}
+	}
+	return parts[0], tags
+}
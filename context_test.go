@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWithTags(t *testing.T) {
+	ctx := WithTags(context.Background(), map[string]string{"route": "/a", "method": "GET"})
+	ctx = WithTags(ctx, map[string]string{"method": "POST"})
+	tags := TagsFromContext(ctx)
+	if 2 != len(tags) || "/a" != tags["route"] || "POST" != tags["method"] {
+		t.Fatal(tags)
+	}
+	tags["route"] = "changed"
+	if tags := TagsFromContext(ctx); "/a" != tags["route"] {
+		t.Fatal(tags)
+	}
+	if tags := TagsFromContext(context.Background()); nil != tags {
+		t.Fatal(tags)
+	}
+}
+
+func TestTaggedName(t *testing.T) {
+	name := TaggedName("requests", map[string]string{"route": "/a;b", "method": "GET"})
+	if "requests;method=GET;route=/a_b" != name {
+		t.Fatal(name)
+	}
+	if name, tags := splitTaggedName(name); "requests" != name || 2 != len(tags) || "/a_b" != tags["route"] {
+		t.Fatal(name, tags)
+	}
+	if name, tags := splitTaggedName("requests"); "requests" != name || nil != tags {
+		t.Fatal(name, tags)
+	}
+}
+
+func TestStatsdContextTags(t *testing.T) {
+	datadog, plain := newStatsdTestServer(t), newStatsdTestServer(t)
+	defer datadog.Close()
+	defer plain.Close()
+	r := NewRegistry()
+	ctx := WithTags(context.Background(), map[string]string{"route": "/a", "method": "GET"})
+	GetOrRegisterTagged(ctx, r, "requests", NewCounter).(Counter).Inc(1)
+	GetOrRegisterTagged(ctx, r, "requests", NewCounter).(Counter).Inc(1)
+	ctx = WithTags(context.Background(), map[string]string{"route": "/b", "method": "GET"})
+	GetOrRegisterTagged(ctx, r, "requests", NewCounter).(Counter).Inc(1)
+	if err := NewStatsdReporter(StatsdConfig{
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		Tags:          map[string]string{"env": "prod"},
+		Targets: []StatsdTarget{
+			{Addr: datadog.Addr(), TagFormat: TagFormatDatadog},
+			{Addr: plain.Addr()},
+		},
+		Collisions: CollisionError,
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	lines := statsdLines(datadog.Packets())
+	if 2 != len(lines) || !lines["p.requests.count:2|c|#env:prod,method:GET,route:/a"] || !lines["p.requests.count:1|c|#env:prod,method:GET,route:/b"] {
+		t.Fatal(lines)
+	}
+	lines = statsdLines(plain.Packets())
+	if 2 != len(lines) || !lines["p.requests.method.GET.route./a.count:2|c"] || !lines["p.requests.method.GET.route./b.count:1|c"] {
+		t.Fatal(lines)
+	}
+}
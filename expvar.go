@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"expvar"
+	"strconv"
+	"time"
+)
+
+// Capture new values for the expvar Ints and Floats imported by ImportExpvar.
+// This is designed to be called as a goroutine.
+func CaptureExpvar(r Registry, d time.Duration) {
+	for _ = range time.Tick(d) {
+		ImportExpvar(r)
+	}
+}
+
+// ImportExpvar mirrors every published expvar Int and Float as a Gauge or
+// GaugeFloat64, respectively, registered in r under the same name so that
+// exporters pick them up.  Each call registers newly published variables and
+// updates those already mirrored.  Variables of other types, and those whose
+// names r already holds a different kind of metric under, are skipped.
+func ImportExpvar(r Registry) {
+	if nil == r {
+		r = DefaultRegistry
+	}
+	expvar.Do(func(kv expvar.KeyValue) {
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			value, err := strconv.ParseInt(v.String(), 10, 64)
+			if nil != err {
+				return
+			}
+			if g, ok := r.GetOrRegister(kv.Key, NewGauge).(Gauge); ok {
+				g.Update(value)
+			}
+		case *expvar.Float:
+			value, err := strconv.ParseFloat(v.String(), 64)
+			if nil != err {
+				return
+			}
+			if g, ok := r.GetOrRegister(kv.Key, NewGaugeFloat64).(GaugeFloat64); ok {
+				g.Update(value)
+			}
+		}
+	})
+}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"expvar"
+	"testing"
+)
+
+func TestImportExpvar(t *testing.T) {
+	i := expvar.NewInt("metrics.TestImportExpvar.int")
+	f := expvar.NewFloat("metrics.TestImportExpvar.float")
+	expvar.NewString("metrics.TestImportExpvar.string").Set("foo")
+	i.Set(47)
+	f.Set(4.7)
+	r := NewRegistry()
+	ImportExpvar(r)
+	if g, ok := r.Get("metrics.TestImportExpvar.int").(Gauge); !ok || 47 != g.Value() {
+		t.Fatal(r.Get("metrics.TestImportExpvar.int"))
+	}
+	if g, ok := r.Get("metrics.TestImportExpvar.float").(GaugeFloat64); !ok || 4.7 != g.Value() {
+		t.Fatal(r.Get("metrics.TestImportExpvar.float"))
+	}
+	if m := r.Get("metrics.TestImportExpvar.string"); nil != m {
+		t.Fatal(m)
+	}
+	i.Add(1)
+	ImportExpvar(r)
+	if g := r.Get("metrics.TestImportExpvar.int").(Gauge); 48 != g.Value() {
+		t.Fatal(g.Value())
+	}
+}
+
+func TestImportExpvarSkipsOtherMetrics(t *testing.T) {
+	expvar.NewInt("metrics.TestImportExpvarSkipsOtherMetrics").Set(1)
+	r := NewRegistry()
+	c := NewRegisteredCounter("metrics.TestImportExpvarSkipsOtherMetrics", r)
+	ImportExpvar(r)
+	if 0 != c.Count() {
+		t.Fatal(c.Count())
+	}
+}
@@ -0,0 +1,50 @@
+package metrics
+
+import "fmt"
+
+// StateGauges are Gauges recording which of a fixed set of named states, such
+// as a circuit breaker's "closed", "open" and "half-open", something is in as
+// the integer code of that state, so exporters send the code.
+type StateGauge struct {
+	Gauge
+	states map[string]int64
+}
+
+// UnknownState is the error returned by StateGauge.Set for a state which has
+// no code.
+type UnknownState string
+
+func (err UnknownState) Error() string {
+	return fmt.Sprintf("unknown state: %s", string(err))
+}
+
+// NewStateGauge constructs a new StateGauge with a copy of the given codes of
+// its states.
+func NewStateGauge(states map[string]int64) *StateGauge {
+	g := &StateGauge{NewGauge(), make(map[string]int64, len(states))}
+	for state, code := range states {
+		g.states[state] = code
+	}
+	return g
+}
+
+// RegisterStateGauge constructs and registers a new StateGauge.
+func RegisterStateGauge(r Registry, name string, states map[string]int64) *StateGauge {
+	g := NewStateGauge(states)
+	if nil == r {
+		r = DefaultRegistry
+	}
+	r.Register(name, g)
+	return g
+}
+
+// Set updates the gauge's value to the code of the given state.  Unknown
+// states leave it unchanged and return an UnknownState.
+func (g *StateGauge) Set(state string) error {
+	code, ok := g.states[state]
+	if !ok {
+		return UnknownState(state)
+	}
+	g.Update(code)
+	return nil
+}
@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStateGauge(t *testing.T) {
+	states := map[string]int64{"closed": 0, "open": 1, "half-open": 2}
+	r := NewRegistry()
+	g := RegisterStateGauge(r, "breaker", states)
+	states["open"] = 47
+	if err := g.Set("open"); nil != err {
+		t.Fatal(err)
+	}
+	if v := r.Get("breaker").(Gauge).Value(); 1 != v {
+		t.Fatal(v)
+	}
+	if err := g.Set("ajar"); UnknownState("ajar") != err {
+		t.Fatal(err)
+	}
+	if v := g.Value(); 1 != v {
+		t.Fatal(v)
+	}
+}
+
+func TestStateGaugeStatsd(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	if err := RegisterStateGauge(r, "breaker", map[string]int64{"closed": 0, "half-open": 2}).Set("half-open"); nil != err {
+		t.Fatal(err)
+	}
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	if lines := statsdLines(server.Packets()); !lines["p.breaker.value:2|g"] {
+		t.Fatal(lines)
+	}
+}
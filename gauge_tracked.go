@@ -0,0 +1,36 @@
+package metrics
+
+import "sync/atomic"
+
+// TrackedGauges are Gauges which record whether they've ever been updated,
+// so exporters can skip those never set rather than send meaningless zeros.
+type TrackedGauge struct {
+	Gauge
+	set int32
+}
+
+// NewTrackedGauge constructs a new TrackedGauge.
+func NewTrackedGauge() *TrackedGauge {
+	return &TrackedGauge{Gauge: NewGauge()}
+}
+
+// NewRegisteredTrackedGauge constructs and registers a new TrackedGauge.
+func NewRegisteredTrackedGauge(name string, r Registry) *TrackedGauge {
+	g := NewTrackedGauge()
+	if nil == r {
+		r = DefaultRegistry
+	}
+	r.Register(name, g)
+	return g
+}
+
+// IsSet returns whether the gauge has ever been updated.
+func (g *TrackedGauge) IsSet() bool {
+	return 1 == atomic.LoadInt32(&g.set)
+}
+
+// Update updates the gauge's value and records that it's been set.
+func (g *TrackedGauge) Update(v int64) {
+	g.Gauge.Update(v)
+	atomic.StoreInt32(&g.set, 1)
+}
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrackedGauge(t *testing.T) {
+	g := NewTrackedGauge()
+	if g.IsSet() {
+		t.Fatal("new gauge is set")
+	}
+	g.Update(0)
+	if !g.IsSet() {
+		t.Fatal("updated gauge isn't set")
+	}
+}
+
+func TestTrackedGaugeStatsd(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredTrackedGauge("unset", r)
+	NewRegisteredTrackedGauge("zero", r).Update(0)
+	NewRegisteredGauge("plain", r)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:            server.Addr(),
+		Registry:        r,
+		FlushInterval:   time.Second,
+		Prefix:          "p",
+		SkipUnsetGauges: true,
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	lines := statsdLines(server.Packets())
+	if 2 != len(lines) || !lines["p.zero.value:0|g"] || !lines["p.plain.value:0|g"] {
+		t.Fatal(lines)
+	}
+}
@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -16,11 +17,53 @@ type GraphiteConfig struct {
 	Addr          *net.TCPAddr  // Network address to connect to
 	Registry      Registry      // Registry to be exported
 	FlushInterval time.Duration // Flush interval
-	DurationUnit  time.Duration // Time conversion unit for durations
+	DurationUnit  time.Duration // Unit durations are divided by, or nanoseconds
 	Prefix        string        // Prefix to be prepended to metric names
 	Percentiles   []float64     // Percentiles to export from timers and histograms
+
+	// Tags are added to every metric name when TagFormat is
+	// TagFormatGraphite, which requires Graphite 1.1 or later.  Characters
+	// Graphite can't carry are replaced with underscores and tags with empty
+	// keys or values are left out and reported by an InvalidTag error.
+	// With TagFormatNone, tags appended to names by TaggedName are instead
+	// appended to them as labels, as by the statsd exporter.  Other formats
+	// can't be carried, so nothing is sent and ErrGraphiteTagFormat is
+	// returned.
+	Tags      map[string]string
+	TagFormat TagFormat
+
+	// TimestampResolution selects the unit of the timestamp ending each
+	// line, seconds unless set to TimestampMilliseconds for carbon relays
+	// which accept them.
+	TimestampResolution TimestampResolution
+
+	// GlobalNamePrefix is prepended verbatim to every metric name ahead of
+	// Prefix, for a top-level namespace such as "prod." shared by every
+	// exporter in an environment.
+	GlobalNamePrefix string
+
+	// Clock schedules flushes and supplies the timestamps sent with them,
+	// SystemClock when nil, so replayed or backfilled metrics may carry
+	// the times they were recorded.
+	Clock Clock
 }
 
+// ErrGraphiteTagFormat is returned by flushes to Graphite configured with a
+// TagFormat other than TagFormatNone or TagFormatGraphite.
+var ErrGraphiteTagFormat = errors.New("graphite: unsupported tag format")
+
+// TimestampResolution selects the unit of the timestamps sent to Graphite.
+type TimestampResolution int
+
+const (
+	// TimestampSeconds sends whole seconds since the Unix epoch, which every
+	// carbon accepts.
+	TimestampSeconds TimestampResolution = iota
+
+	// TimestampMilliseconds sends milliseconds since the Unix epoch.
+	TimestampMilliseconds
+)
+
 // Graphite is a blocking exporter function which reports metrics in r
 // to a graphite server located at addr, flushing them every d duration
 // and prepending metric names with prefix.
@@ -38,67 +81,103 @@ func Graphite(r Registry, d time.Duration, prefix string, addr *net.TCPAddr) {
 // GraphiteWithConfig is a blocking exporter function just like Graphite,
 // but it takes a GraphiteConfig instead.
 func GraphiteWithConfig(c GraphiteConfig) {
-	for _ = range time.Tick(c.FlushInterval) {
+	ticker := c.clock().NewTicker(c.FlushInterval)
+	for range ticker.C() {
 		if err := graphite(&c); nil != err {
 			log.Println(err)
 		}
 	}
 }
 
+// clock returns the Clock used to schedule flushes and timestamp metrics.
+func (c *GraphiteConfig) clock() Clock {
+	if nil == c.Clock {
+		return SystemClock
+	}
+	return c.Clock
+}
+
 func graphite(c *GraphiteConfig) error {
-	now := time.Now().Unix()
+	if TagFormatNone != c.TagFormat && TagFormatGraphite != c.TagFormat {
+		return ErrGraphiteTagFormat
+	}
+	start := c.clock().Now()
+	now := start.Unix()
+	if TimestampMilliseconds == c.TimestampResolution {
+		now = start.UnixNano() / int64(time.Millisecond)
+	}
 	du := float64(c.DurationUnit)
+	if 0 == du {
+		du = float64(time.Nanosecond)
+	}
+	prefix := c.GlobalNamePrefix + c.Prefix
 	conn, err := net.DialTCP("tcp", nil, c.Addr)
 	if nil != err {
 		return err
 	}
 	defer conn.Close()
 	w := bufio.NewWriter(conn)
+	var tags string
+	if TagFormatGraphite == c.TagFormat {
+		tags, err = encodeTags(c.Tags, c.TagFormat, false)
+	}
 	c.Registry.Each(func(name string, i interface{}) {
+		// Tags appended to the name by TaggedName are moved after the
+		// suffixes added below, where Graphite expects them, or else
+		// appended to the name as labels.
+		name, nameTags := splitTaggedName(name)
+		tags := tags
+		if 0 < len(nameTags) {
+			if TagFormatGraphite == c.TagFormat {
+				tags, _ = encodeTags(mergeTags(c.Tags, nameTags), c.TagFormat, false)
+			} else {
+				name = labelName(name, nameTags)
+			}
+		}
 		switch metric := i.(type) {
 		case Counter:
-			fmt.Fprintf(w, "%s.%s.count %d %d\n", c.Prefix, name, metric.Count(), now)
+			fmt.Fprintf(w, "%s.%s.count%s %d %d\n", prefix, name, tags, metric.Count(), now)
 		case Gauge:
-			fmt.Fprintf(w, "%s.%s.value %d %d\n", c.Prefix, name, metric.Value(), now)
+			fmt.Fprintf(w, "%s.%s.value%s %d %d\n", prefix, name, tags, metric.Value(), now)
 		case GaugeFloat64:
-			fmt.Fprintf(w, "%s.%s.value %f %d\n", c.Prefix, name, metric.Value(), now)
+			fmt.Fprintf(w, "%s.%s.value%s %f %d\n", prefix, name, tags, metric.Value(), now)
 		case Histogram:
 			h := metric.Snapshot()
 			ps := h.Percentiles(c.Percentiles)
-			fmt.Fprintf(w, "%s.%s.count %d %d\n", c.Prefix, name, h.Count(), now)
-			fmt.Fprintf(w, "%s.%s.min %d %d\n", c.Prefix, name, h.Min(), now)
-			fmt.Fprintf(w, "%s.%s.max %d %d\n", c.Prefix, name, h.Max(), now)
-			fmt.Fprintf(w, "%s.%s.mean %.2f %d\n", c.Prefix, name, h.Mean(), now)
-			fmt.Fprintf(w, "%s.%s.std-dev %.2f %d\n", c.Prefix, name, h.StdDev(), now)
+			fmt.Fprintf(w, "%s.%s.count%s %d %d\n", prefix, name, tags, h.Count(), now)
+			fmt.Fprintf(w, "%s.%s.min%s %d %d\n", prefix, name, tags, h.Min(), now)
+			fmt.Fprintf(w, "%s.%s.max%s %d %d\n", prefix, name, tags, h.Max(), now)
+			fmt.Fprintf(w, "%s.%s.mean%s %.2f %d\n", prefix, name, tags, h.Mean(), now)
+			fmt.Fprintf(w, "%s.%s.std-dev%s %.2f %d\n", prefix, name, tags, h.StdDev(), now)
 			for psIdx, psKey := range c.Percentiles {
 				key := strings.Replace(strconv.FormatFloat(psKey*100.0, 'f', -1, 64), ".", "", 1)
-				fmt.Fprintf(w, "%s.%s.%s-percentile %.2f %d\n", c.Prefix, name, key, ps[psIdx], now)
+				fmt.Fprintf(w, "%s.%s.%s-percentile%s %.2f %d\n", prefix, name, key, tags, ps[psIdx], now)
 			}
 		case Meter:
 			m := metric.Snapshot()
-			fmt.Fprintf(w, "%s.%s.count %d %d\n", c.Prefix, name, m.Count(), now)
-			fmt.Fprintf(w, "%s.%s.one-minute %.2f %d\n", c.Prefix, name, m.Rate1(), now)
-			fmt.Fprintf(w, "%s.%s.five-minute %.2f %d\n", c.Prefix, name, m.Rate5(), now)
-			fmt.Fprintf(w, "%s.%s.fifteen-minute %.2f %d\n", c.Prefix, name, m.Rate15(), now)
-			fmt.Fprintf(w, "%s.%s.mean %.2f %d\n", c.Prefix, name, m.RateMean(), now)
+			fmt.Fprintf(w, "%s.%s.count%s %d %d\n", prefix, name, tags, m.Count(), now)
+			fmt.Fprintf(w, "%s.%s.one-minute%s %.2f %d\n", prefix, name, tags, m.Rate1(), now)
+			fmt.Fprintf(w, "%s.%s.five-minute%s %.2f %d\n", prefix, name, tags, m.Rate5(), now)
+			fmt.Fprintf(w, "%s.%s.fifteen-minute%s %.2f %d\n", prefix, name, tags, m.Rate15(), now)
+			fmt.Fprintf(w, "%s.%s.mean%s %.2f %d\n", prefix, name, tags, m.RateMean(), now)
 		case Timer:
 			t := metric.Snapshot()
 			ps := t.Percentiles(c.Percentiles)
-			fmt.Fprintf(w, "%s.%s.count %d %d\n", c.Prefix, name, t.Count(), now)
-			fmt.Fprintf(w, "%s.%s.min %d %d\n", c.Prefix, name, int64(du)*t.Min(), now)
-			fmt.Fprintf(w, "%s.%s.max %d %d\n", c.Prefix, name, int64(du)*t.Max(), now)
-			fmt.Fprintf(w, "%s.%s.mean %.2f %d\n", c.Prefix, name, du*t.Mean(), now)
-			fmt.Fprintf(w, "%s.%s.std-dev %.2f %d\n", c.Prefix, name, du*t.StdDev(), now)
+			fmt.Fprintf(w, "%s.%s.count%s %d %d\n", prefix, name, tags, t.Count(), now)
+			fmt.Fprintf(w, "%s.%s.min%s %d %d\n", prefix, name, tags, t.Min()/int64(du), now)
+			fmt.Fprintf(w, "%s.%s.max%s %d %d\n", prefix, name, tags, t.Max()/int64(du), now)
+			fmt.Fprintf(w, "%s.%s.mean%s %.2f %d\n", prefix, name, tags, t.Mean()/du, now)
+			fmt.Fprintf(w, "%s.%s.std-dev%s %.2f %d\n", prefix, name, tags, t.StdDev()/du, now)
 			for psIdx, psKey := range c.Percentiles {
 				key := strings.Replace(strconv.FormatFloat(psKey*100.0, 'f', -1, 64), ".", "", 1)
-				fmt.Fprintf(w, "%s.%s.%s-percentile %.2f %d\n", c.Prefix, name, key, ps[psIdx], now)
+				fmt.Fprintf(w, "%s.%s.%s-percentile%s %.2f %d\n", prefix, name, key, tags, ps[psIdx], now)
 			}
-			fmt.Fprintf(w, "%s.%s.one-minute %.2f %d\n", c.Prefix, name, t.Rate1(), now)
-			fmt.Fprintf(w, "%s.%s.five-minute %.2f %d\n", c.Prefix, name, t.Rate5(), now)
-			fmt.Fprintf(w, "%s.%s.fifteen-minute %.2f %d\n", c.Prefix, name, t.Rate15(), now)
-			fmt.Fprintf(w, "%s.%s.mean-rate %.2f %d\n", c.Prefix, name, t.RateMean(), now)
+			fmt.Fprintf(w, "%s.%s.one-minute%s %.2f %d\n", prefix, name, tags, t.Rate1(), now)
+			fmt.Fprintf(w, "%s.%s.five-minute%s %.2f %d\n", prefix, name, tags, t.Rate5(), now)
+			fmt.Fprintf(w, "%s.%s.fifteen-minute%s %.2f %d\n", prefix, name, tags, t.Rate15(), now)
+			fmt.Fprintf(w, "%s.%s.mean-rate%s %.2f %d\n", prefix, name, tags, t.RateMean(), now)
 		}
 		w.Flush()
 	})
-	return nil
+	return err
 }
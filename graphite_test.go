@@ -1,7 +1,11 @@
 package metrics
 
 import (
+	"bufio"
 	"net"
+	"strconv"
+	"strings"
+	"testing"
 	"time"
 )
 
@@ -20,3 +24,170 @@ func ExampleGraphiteWithConfig() {
 		Percentiles: []float64{ 0.5, 0.75, 0.99, 0.999 },
 	})
 }
+
+// graphiteLines flushes c to a listener it sets as c.Addr and returns the
+// lines received.
+func graphiteLines(t *testing.T, c GraphiteConfig) []string {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan []string)
+	go func() {
+		conn, err := l.Accept()
+		if nil != err {
+			close(lines)
+			return
+		}
+		defer conn.Close()
+		var ls []string
+		for s := bufio.NewScanner(conn); s.Scan(); {
+			ls = append(ls, s.Text())
+		}
+		lines <- ls
+	}()
+	c.Addr = l.Addr().(*net.TCPAddr)
+	if err := graphite(&c); nil != err {
+		t.Fatal(err)
+	}
+	return <-lines
+}
+
+func TestGraphiteTags(t *testing.T) {
+	r := NewRegistry()
+	NewRegisteredGauge("foo", r).Update(1)
+	ls := graphiteLines(t, GraphiteConfig{
+		Registry:  r,
+		Prefix:    "p",
+		Tags:      map[string]string{"env": "prod", "region": "us;east"},
+		TagFormat: TagFormatGraphite,
+	})
+	if 1 != len(ls) || !strings.HasPrefix(ls[0], "p.foo.value;env=prod;region=us_east 1 ") {
+		t.Fatalf("%q", ls)
+	}
+}
+
+func TestGraphiteTimestampResolution(t *testing.T) {
+	for resolution, unit := range map[TimestampResolution]time.Duration{
+		TimestampSeconds:      time.Second,
+		TimestampMilliseconds: time.Millisecond,
+	} {
+		r := NewRegistry()
+		NewRegisteredGauge("foo", r).Update(1)
+		before := time.Now().UnixNano() / int64(unit)
+		ls := graphiteLines(t, GraphiteConfig{
+			Registry:            r,
+			Prefix:              "p",
+			TimestampResolution: resolution,
+		})
+		after := time.Now().UnixNano() / int64(unit)
+		if 1 != len(ls) {
+			t.Fatalf("%q", ls)
+		}
+		fields := strings.Fields(ls[0])
+		ts, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if ts < before || after < ts {
+			t.Errorf("resolution %d: %d not in [%d, %d]", resolution, ts, before, after)
+		}
+	}
+}
+
+func TestGraphiteGlobalNamePrefix(t *testing.T) {
+	r := NewRegistry()
+	NewRegisteredGauge("foo", r).Update(1)
+	ls := graphiteLines(t, GraphiteConfig{
+		Registry:         r,
+		Prefix:           "p",
+		GlobalNamePrefix: "prod.",
+	})
+	if 1 != len(ls) || !strings.HasPrefix(ls[0], "prod.p.foo.value 1 ") {
+		t.Fatalf("%q", ls)
+	}
+}
+
+func TestGraphiteClock(t *testing.T) {
+	for resolution, expected := range map[TimestampResolution]string{
+		TimestampSeconds:      "p.foo.value 1 1000000000",
+		TimestampMilliseconds: "p.foo.value 1 1000000000000",
+	} {
+		r := NewRegistry()
+		NewRegisteredGauge("foo", r).Update(1)
+		ls := graphiteLines(t, GraphiteConfig{
+			Registry:            r,
+			Prefix:              "p",
+			TimestampResolution: resolution,
+			Clock:               newFakeClock(),
+		})
+		if 1 != len(ls) || expected != ls[0] {
+			t.Errorf("resolution %d: %q", resolution, ls)
+		}
+	}
+}
+
+func TestGraphiteDurationUnit(t *testing.T) {
+	r := NewRegistry()
+	NewRegisteredTimer("foo", r).Update(1500 * time.Microsecond)
+	ls := graphiteLines(t, GraphiteConfig{
+		Registry:     r,
+		Prefix:       "p",
+		DurationUnit: time.Millisecond,
+	})
+	lines := make(map[string]bool)
+	for _, l := range ls {
+		lines[l[:strings.LastIndex(l, " ")]] = true
+	}
+	for _, line := range []string{"p.foo.max 1", "p.foo.mean 1.50"} {
+		if !lines[line] {
+			t.Errorf("%s missing from %v", line, lines)
+		}
+	}
+}
+
+func TestGraphiteTaggedName(t *testing.T) {
+	r := NewRegistry()
+	NewRegisteredCounter(TaggedName("foo", map[string]string{"env": "prod", "route": "/a;b"}), r).Inc(1)
+	ls := graphiteLines(t, GraphiteConfig{
+		Registry:  r,
+		Prefix:    "p",
+		Tags:      map[string]string{"env": "dev", "region": "us"},
+		TagFormat: TagFormatGraphite,
+	})
+	if 1 != len(ls) || !strings.HasPrefix(ls[0], "p.foo.count;env=prod;region=us;route=/a_b 1 ") {
+		t.Fatalf("%q", ls)
+	}
+	ls = graphiteLines(t, GraphiteConfig{
+		Registry: r,
+		Prefix:   "p",
+	})
+	if 1 != len(ls) || !strings.HasPrefix(ls[0], "p.foo.env.prod.route./a_b.count 1 ") {
+		t.Fatalf("%q", ls)
+	}
+}
+
+func TestGraphiteTaggedNameSanitized(t *testing.T) {
+	r := NewRegistry()
+	NewRegisteredCounter(TaggedName("foo", map[string]string{"url": "http://x:1|2"}), r).Inc(1)
+	ls := graphiteLines(t, GraphiteConfig{
+		Registry:  r,
+		Prefix:    "p",
+		TagFormat: TagFormatGraphite,
+	})
+	if 1 != len(ls) || !strings.HasPrefix(ls[0], "p.foo.count;url=http_//x_1_2 1 ") {
+		t.Fatalf("%q", ls)
+	}
+}
+
+func TestGraphiteTagFormatUnsupported(t *testing.T) {
+	r := NewRegistry()
+	NewRegisteredCounter("foo", r).Inc(1)
+	if err := graphite(&GraphiteConfig{
+		Registry:  r,
+		TagFormat: TagFormatDatadog,
+	}); ErrGraphiteTagFormat != err {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,51 @@
+package metrics
+
+// Infos are Gauges whose value is always 1 and whose labels describe
+// something constant about the process, such as its version or build, after
+// Prometheus' "_info" metrics.
+type Info interface {
+	Gauge
+	Labels() map[string]string
+}
+
+// NewInfo constructs a new StandardInfo with a copy of the given labels.
+func NewInfo(labels map[string]string) Info {
+	i := &StandardInfo{make(map[string]string, len(labels))}
+	for key, value := range labels {
+		i.labels[key] = value
+	}
+	return i
+}
+
+// RegisterInfo constructs and registers a new StandardInfo.
+func RegisterInfo(r Registry, name string, labels map[string]string) {
+	if nil == r {
+		r = DefaultRegistry
+	}
+	r.Register(name, NewInfo(labels))
+}
+
+// StandardInfo is the standard implementation of an Info.
+type StandardInfo struct {
+	labels map[string]string
+}
+
+// Labels returns a copy of the info's labels.
+func (i *StandardInfo) Labels() map[string]string {
+	labels := make(map[string]string, len(i.labels))
+	for key, value := range i.labels {
+		labels[key] = value
+	}
+	return labels
+}
+
+// Snapshot returns the info, which never changes.
+func (i *StandardInfo) Snapshot() Gauge { return i }
+
+// Update panics.
+func (*StandardInfo) Update(int64) {
+	panic("Update called on a StandardInfo")
+}
+
+// Value returns 1.
+func (*StandardInfo) Value() int64 { return 1 }
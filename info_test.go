@@ -0,0 +1,20 @@
+package metrics
+
+import "testing"
+
+func TestRegisterInfo(t *testing.T) {
+	r := NewRegistry()
+	labels := map[string]string{"version": "1.2.3"}
+	RegisterInfo(r, "build", labels)
+	labels["version"] = "changed"
+	i, ok := r.Get("build").(Info)
+	if !ok {
+		t.Fatal(r.Get("build"))
+	}
+	if 1 != i.Value() || 1 != i.Snapshot().Value() {
+		t.Fatal(i.Value())
+	}
+	if l := i.Labels(); 1 != len(l) || "1.2.3" != l["version"] {
+		t.Fatal(l)
+	}
+}
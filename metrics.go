@@ -5,9 +5,34 @@
 // Coda Hale's original work: <https://github.com/codahale/metrics>
 package metrics
 
+import "strings"
+
 // UseNilMetrics is checked by the constructor functions for all of the
 // standard metrics.  If it is true, the metric returned is a stub.
 //
 // This global kill-switch helps quantify the observer effect and makes
 // for less cluttered pprof profiles.
 var UseNilMetrics bool = false
+
+// BuildMetricName joins prefix, name and suffix with separator, "." if it's
+// empty, leaving out those which are empty and not doubling a separator
+// prefix already ends with, so that exporters and callers build the same
+// names.
+func BuildMetricName(prefix, name, suffix, separator string) string {
+	if "" == separator {
+		separator = "."
+	}
+	prefix = strings.TrimSuffix(prefix, separator)
+	if "" == name {
+		name = prefix
+	} else if "" != prefix {
+		name = prefix + separator + name
+	}
+	if "" == suffix {
+		return name
+	}
+	if "" == name {
+		return suffix
+	}
+	return name + separator + suffix
+}
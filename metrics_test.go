@@ -105,3 +105,24 @@ func BenchmarkMetrics(b *testing.B) {
 	wgR.Wait()
 	wgW.Wait()
 }
+
+func TestBuildMetricName(t *testing.T) {
+	for _, c := range []struct {
+		prefix, name, suffix, separator, expected string
+	}{
+		{"p", "foo", "count", ".", "p.foo.count"},
+		{"", "foo", "count", ".", "foo.count"},
+		{"p.", "foo", "count", ".", "p.foo.count"},
+		{"p", "foo", "", ".", "p.foo"},
+		{"p", "", "count", ".", "p.count"},
+		{"p", "foo", "count", "", "p.foo.count"},
+		{"p", "foo", "count", "_", "p_foo_count"},
+		{"p_", "foo", "count", "_", "p_foo_count"},
+		{"p.", "foo", "count", "_", "p._foo_count"},
+		{"", "", "", ".", ""},
+	} {
+		if name := BuildMetricName(c.prefix, c.name, c.suffix, c.separator); c.expected != name {
+			t.Errorf("BuildMetricName(%q, %q, %q, %q): %q != %q", c.prefix, c.name, c.suffix, c.separator, c.expected, name)
+		}
+	}
+}
@@ -124,15 +124,40 @@ func (r *StandardRegistry) register(name string, i interface{}) error {
 }
 
 func (r *StandardRegistry) registered() map[string]interface{} {
-	metrics := make(map[string]interface{}, len(r.metrics))
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
+	metrics := make(map[string]interface{}, len(r.metrics))
 	for name, i := range r.metrics {
 		metrics[name] = i
 	}
 	return metrics
 }
 
+// eachSnapshot calls the given function for each metric registered in r
+// when it's called, copied first so that metrics may be registered and
+// unregistered concurrently, even with Registry implementations whose Each
+// doesn't allow that.  A ShardedRegistry is copied a shard at a time.
+func eachSnapshot(r Registry, f func(string, interface{})) {
+	if sr, ok := r.(*ShardedRegistry); ok {
+		for _, shard := range sr.shards {
+			eachSnapshot(shard, f)
+		}
+		return
+	}
+	var metrics map[string]interface{}
+	if sr, ok := r.(*StandardRegistry); ok {
+		metrics = sr.registered()
+	} else {
+		metrics = make(map[string]interface{})
+		r.Each(func(name string, i interface{}) {
+			metrics[name] = i
+		})
+	}
+	for name, i := range metrics {
+		f(name, i)
+	}
+}
+
 var DefaultRegistry Registry = NewRegistry()
 
 // Call the given function for each registered metric.
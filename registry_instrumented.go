@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// InstrumentedRegistry wraps a Registry, holding a lock of its own around
+// calls to Each and GetOrRegister and measuring how often and for how long
+// they wait for it, to help diagnose the overhead of recording metrics in
+// hot code.  The number of calls which waited is exported as the gauge
+// registry.contention and the total time they waited, in nanoseconds, as
+// the gauge registry.contention-wait.
+type InstrumentedRegistry struct {
+	Registry
+	contention     Gauge
+	contentionWait Gauge
+	contended      int64
+	mutex          sync.Mutex
+	waited         int64
+}
+
+// NewInstrumentedRegistry constructs a new InstrumentedRegistry wrapping r,
+// registering its registry.contention and registry.contention-wait gauges
+// in r.
+func NewInstrumentedRegistry(r Registry) *InstrumentedRegistry {
+	return &InstrumentedRegistry{
+		Registry:       r,
+		contention:     GetOrRegisterGauge("registry.contention", r),
+		contentionWait: GetOrRegisterGauge("registry.contention-wait", r),
+	}
+}
+
+// Contention returns the number of calls to Each and GetOrRegister which
+// waited for another to release the registry's lock.
+func (r *InstrumentedRegistry) Contention() int64 {
+	return atomic.LoadInt64(&r.contended)
+}
+
+// ContentionWait returns the total time calls to Each and GetOrRegister
+// waited for the registry's lock.
+func (r *InstrumentedRegistry) ContentionWait() time.Duration {
+	return time.Duration(atomic.LoadInt64(&r.waited))
+}
+
+// Each calls the given function for each registered metric, copied first so
+// that only the copying holds the registry's lock.
+func (r *InstrumentedRegistry) Each(f func(string, interface{})) {
+	metrics := make(map[string]interface{})
+	r.lock()
+	r.Registry.Each(func(name string, i interface{}) {
+		metrics[name] = i
+	})
+	r.mutex.Unlock()
+	for name, i := range metrics {
+		f(name, i)
+	}
+}
+
+// GetOrRegister gets an existing metric or registers the given one.
+func (r *InstrumentedRegistry) GetOrRegister(name string, i interface{}) interface{} {
+	r.lock()
+	defer r.mutex.Unlock()
+	return r.Registry.GetOrRegister(name, i)
+}
+
+// lock acquires the registry's lock, counting the call and the time it
+// waits if the lock is already held.
+func (r *InstrumentedRegistry) lock() {
+	if r.mutex.TryLock() {
+		return
+	}
+	start := time.Now()
+	r.contention.Update(atomic.AddInt64(&r.contended, 1))
+	r.mutex.Lock()
+	r.contentionWait.Update(atomic.AddInt64(&r.waited, int64(time.Since(start))))
+}
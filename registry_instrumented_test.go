@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+)
+
+// signalGauge is a Gauge which signals every update.
+type signalGauge struct {
+	Gauge
+	updated chan int64
+}
+
+func (g signalGauge) Update(v int64) {
+	g.Gauge.Update(v)
+	g.updated <- v
+}
+
+func TestInstrumentedRegistry(t *testing.T) {
+	inner := NewRegistry()
+	contention := signalGauge{NewGauge(), make(chan int64, 1)}
+	inner.Register("registry.contention", contention)
+	r := NewInstrumentedRegistry(inner)
+	started, release := make(chan struct{}), make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r.GetOrRegister("slow", func() Counter {
+			close(started)
+			<-release
+			return NewCounter()
+		})
+	}()
+	<-started
+	go func() {
+		defer wg.Done()
+		r.GetOrRegister("fast", NewCounter())
+	}()
+
+	// The fast call counts itself as contended before it waits, so the slow
+	// call is released only once it's waiting.
+	<-contention.updated
+	close(release)
+	wg.Wait()
+	r.GetOrRegister("uncontended", NewCounter())
+	if n := r.Contention(); 1 != n {
+		t.Fatal(n)
+	}
+	if v := r.Get("registry.contention").(Gauge).Value(); 1 != v {
+		t.Fatal(v)
+	}
+	wait := r.ContentionWait()
+	if wait <= 0 {
+		t.Fatal(wait)
+	}
+	if v := r.Get("registry.contention-wait").(Gauge).Value(); int64(wait) != v {
+		t.Fatal(v, wait)
+	}
+	names := make(map[string]bool)
+	r.Each(func(name string, _ interface{}) {
+		names[name] = true
+	})
+	if 5 != len(names) || !names["slow"] || !names["fast"] || !names["registry.contention"] || !names["registry.contention-wait"] {
+		t.Fatal(names)
+	}
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import "hash/fnv"
+
+// ShardedRegistry is a Registry which splits its metrics by name between
+// several StandardRegistries, each with its own lock, so that exporters
+// copying huge registries hold each lock only while copying its shard and
+// recording goroutines contend with them less.
+type ShardedRegistry struct {
+	shards []*StandardRegistry
+}
+
+// NewShardedRegistry creates a new registry of the given number of shards,
+// at least one.
+func NewShardedRegistry(shards int) Registry {
+	if shards < 1 {
+		shards = 1
+	}
+	r := &ShardedRegistry{shards: make([]*StandardRegistry, shards)}
+	for i := range r.shards {
+		r.shards[i] = NewRegistry().(*StandardRegistry)
+	}
+	return r
+}
+
+// Call the given function for each registered metric, shard by shard.
+func (r *ShardedRegistry) Each(f func(string, interface{})) {
+	for _, shard := range r.shards {
+		shard.Each(f)
+	}
+}
+
+// Get the metric by the given name or nil if none is registered.
+func (r *ShardedRegistry) Get(name string) interface{} {
+	return r.shard(name).Get(name)
+}
+
+// Gets an existing metric or creates and registers a new one.
+func (r *ShardedRegistry) GetOrRegister(name string, i interface{}) interface{} {
+	return r.shard(name).GetOrRegister(name, i)
+}
+
+// Register the given metric under the given name.  Returns a DuplicateMetric
+// if a metric by the given name is already registered.
+func (r *ShardedRegistry) Register(name string, i interface{}) error {
+	return r.shard(name).Register(name, i)
+}
+
+// Run all registered healthchecks.
+func (r *ShardedRegistry) RunHealthchecks() {
+	for _, shard := range r.shards {
+		shard.RunHealthchecks()
+	}
+}
+
+// Unregister the metric with the given name.
+func (r *ShardedRegistry) Unregister(name string) {
+	r.shard(name).Unregister(name)
+}
+
+// shard returns the shard holding metrics of the given name.
+func (r *ShardedRegistry) shard(name string) *StandardRegistry {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return r.shards[h.Sum32()%uint32(len(r.shards))]
+}
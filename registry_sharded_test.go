@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestShardedRegistry(t *testing.T) {
+	r := NewShardedRegistry(4)
+	for i := 0; i < 100; i++ {
+		NewRegisteredCounter(fmt.Sprintf("foo%d", i), r).Inc(int64(i))
+	}
+	if err := r.Register("foo47", NewCounter()); (DuplicateMetric("foo47")) != err {
+		t.Fatal(err)
+	}
+	if c := r.Get("foo47").(Counter).Count(); 47 != c {
+		t.Fatal(c)
+	}
+	r.Unregister("foo47")
+	if nil != r.Get("foo47") {
+		t.Fatal("foo47 still registered")
+	}
+	names := make(map[string]bool)
+	eachSnapshot(r, func(name string, _ interface{}) {
+		names[name] = true
+	})
+	if 99 != len(names) || !names["foo0"] || !names["foo99"] {
+		t.Fatal(names)
+	}
+}
+
+func TestShardedRegistryPerShardLocking(t *testing.T) {
+	r := NewShardedRegistry(2).(*ShardedRegistry)
+	locked := r.shard("foo")
+	var name string
+	for i := 0; "" == name; i++ {
+		if candidate := fmt.Sprintf("bar%d", i); locked != r.shard(candidate) {
+			name = candidate
+		}
+	}
+
+	// Recording in one shard goes ahead while another is locked, as it is
+	// while an exporter copies it.
+	locked.mutex.Lock()
+	defer locked.mutex.Unlock()
+	done := make(chan struct{})
+	go func() {
+		GetOrRegisterCounter(name, r).Inc(1)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("recording blocked by another shard's lock")
+	}
+}
@@ -1,6 +1,9 @@
 package metrics
 
-import "testing"
+import (
+	"sync"
+	"testing"
+)
 
 func BenchmarkRegistry(b *testing.B) {
 	r := NewRegistry()
@@ -116,3 +119,38 @@ func TestRegistryGetOrRegisterWithLazyInstantiation(t *testing.T) {
 		t.Fatal(i)
 	}
 }
+
+// lockedEachRegistry holds its lock while calling Each's function, as naive
+// Registry implementations do, so registering from it would deadlock.
+type lockedEachRegistry struct {
+	mutex   sync.Mutex
+	metrics map[string]interface{}
+	Registry
+}
+
+func (r *lockedEachRegistry) Each(f func(string, interface{})) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for name, i := range r.metrics {
+		f(name, i)
+	}
+}
+
+func (r *lockedEachRegistry) Register(name string, i interface{}) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.metrics[name] = i
+	return nil
+}
+
+func TestEachSnapshot(t *testing.T) {
+	r := &lockedEachRegistry{metrics: map[string]interface{}{"foo": NewCounter()}}
+	n := 0
+	eachSnapshot(r, func(name string, i interface{}) {
+		n++
+		r.Register(name+".bar", NewCounter())
+	})
+	if 1 != n || 2 != len(r.metrics) {
+		t.Fatal(n, r.metrics)
+	}
+}
@@ -40,11 +40,19 @@ var (
 		NumGoroutine Gauge
 		ReadMemStats Timer
 	}
-	frees       uint64
-	lookups     uint64
-	mallocs     uint64
-	numGC       uint32
-	numCgoCalls int64
+	runtimeBasicMetrics struct {
+		HeapAlloc    Gauge
+		NumGC        Gauge
+		NumGoroutine Gauge
+		PauseTotalNs Gauge
+		Uptime       Gauge
+	}
+	registeredAt time.Time
+	frees        uint64
+	lookups      uint64
+	mallocs      uint64
+	numGC        uint32
+	numCgoCalls  int64
 )
 
 // Capture new values for the Go runtime statistics exported in
@@ -198,3 +206,48 @@ func RegisterRuntimeMemStats(r Registry) {
 	r.Register("runtime.NumGoroutine", runtimeMetrics.NumGoroutine)
 	r.Register("runtime.ReadMemStats", runtimeMetrics.ReadMemStats)
 }
+
+// Capture new values for the basic Go runtime statistics registered by
+// RegisterRuntimeMetrics.  This is designed to be called as a goroutine.
+func CaptureRuntimeMetrics(r Registry, d time.Duration) {
+	for _ = range time.Tick(d) {
+		CaptureRuntimeMetricsOnce(r)
+	}
+}
+
+// Capture new values for the basic Go runtime statistics registered by
+// RegisterRuntimeMetrics.  Giving a registry which has not been given to
+// RegisterRuntimeMetrics will panic.  The same stop-the-world caveat as
+// CaptureRuntimeMemStatsOnce applies.
+func CaptureRuntimeMetricsOnce(r Registry) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	runtimeBasicMetrics.HeapAlloc.Update(int64(ms.HeapAlloc))
+	runtimeBasicMetrics.NumGC.Update(int64(ms.NumGC))
+	runtimeBasicMetrics.NumGoroutine.Update(int64(runtime.NumGoroutine()))
+	runtimeBasicMetrics.PauseTotalNs.Update(int64(ms.PauseTotalNs))
+	runtimeBasicMetrics.Uptime.Update(int64(time.Since(registeredAt)))
+}
+
+// Register a small set of the most commonly watched Go runtime statistics:
+// the number of goroutines, heap allocation, GC count and total GC pause
+// time, plus the nanoseconds since registration.  They are named like those
+// of RegisterRuntimeMemStats, which exports a superset of them, so only one
+// of the two should be given a registry.  The gauges are captured once here
+// and thereafter by CaptureRuntimeMetrics or CaptureRuntimeMetricsOnce.
+func RegisterRuntimeMetrics(r Registry) {
+	registeredAt = time.Now()
+	runtimeBasicMetrics.HeapAlloc = NewGauge()
+	runtimeBasicMetrics.NumGC = NewGauge()
+	runtimeBasicMetrics.NumGoroutine = NewGauge()
+	runtimeBasicMetrics.PauseTotalNs = NewGauge()
+	runtimeBasicMetrics.Uptime = NewGauge()
+
+	r.Register("runtime.MemStats.HeapAlloc", runtimeBasicMetrics.HeapAlloc)
+	r.Register("runtime.MemStats.NumGC", runtimeBasicMetrics.NumGC)
+	r.Register("runtime.MemStats.PauseTotalNs", runtimeBasicMetrics.PauseTotalNs)
+	r.Register("runtime.NumGoroutine", runtimeBasicMetrics.NumGoroutine)
+	r.Register("runtime.Uptime", runtimeBasicMetrics.Uptime)
+
+	CaptureRuntimeMetricsOnce(r)
+}
@@ -76,3 +76,27 @@ func testRuntimeMemStatsBlocking(ch chan int) {
 		}
 	}
 }
+
+func TestRuntimeMetrics(t *testing.T) {
+	r := NewRegistry()
+	RegisterRuntimeMetrics(r)
+	for _, name := range []string{
+		"runtime.MemStats.HeapAlloc",
+		"runtime.MemStats.NumGC",
+		"runtime.MemStats.PauseTotalNs",
+		"runtime.NumGoroutine",
+		"runtime.Uptime",
+	} {
+		if _, ok := r.Get(name).(Gauge); !ok {
+			t.Errorf("%s not registered", name)
+		}
+	}
+	if v := r.Get("runtime.NumGoroutine").(Gauge).Value(); 0 >= v {
+		t.Errorf("runtime.NumGoroutine: %v", v)
+	}
+	runtime.GC()
+	CaptureRuntimeMetricsOnce(r)
+	if v := r.Get("runtime.MemStats.NumGC").(Gauge).Value(); 0 >= v {
+		t.Errorf("runtime.MemStats.NumGC: %v", v)
+	}
+}
@@ -296,6 +296,27 @@ func SamplePercentiles(values int64Slice, ps []float64) []float64 {
 	return scores
 }
 
+// SamplePercentilesNearestRank returns a slice of arbitrary percentiles of
+// the slice of int64 using the nearest-rank method.  Unlike
+// SamplePercentiles, every score is a value that was actually sampled.
+func SamplePercentilesNearestRank(values int64Slice, ps []float64) []float64 {
+	scores := make([]float64, len(ps))
+	size := len(values)
+	if size > 0 {
+		sort.Sort(values)
+		for i, p := range ps {
+			rank := int(math.Ceil(p * float64(size)))
+			if rank < 1 {
+				rank = 1
+			} else if rank > size {
+				rank = size
+			}
+			scores[i] = float64(values[rank-1])
+		}
+	}
+	return scores
+}
+
 // SampleSnapshot is a read-only copy of another Sample.
 type SampleSnapshot struct {
 	count  int64
@@ -350,3 +350,23 @@ func TestUniformSampleConcurrentUpdateCount(t *testing.T) {
 	}
 	quit <- struct{}{}
 }
+
+func TestSamplePercentilesNearestRank(t *testing.T) {
+	values := make(int64Slice, 20)
+	for i := range values {
+		values[i] = int64(20 - i)
+	}
+	ps := SamplePercentilesNearestRank(values, []float64{0.0, 0.5, 0.95, 1.0})
+	if 1 != ps[0] {
+		t.Errorf("p0: 1 != %v\n", ps[0])
+	}
+	if 10 != ps[1] {
+		t.Errorf("p50: 10 != %v\n", ps[1])
+	}
+	if 19 != ps[2] {
+		t.Errorf("p95: 19 != %v\n", ps[2])
+	}
+	if 20 != ps[3] {
+		t.Errorf("p100: 20 != %v\n", ps[3])
+	}
+}
@@ -3,10 +3,16 @@ package metrics
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"math/rand"
 	"net"
+	"net/http"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,72 +22,2091 @@ import (
 type StatsdConfig struct {
 	Addr          string        // Network address to connect to
 	Registry      Registry      // Registry to be exported
+	Registries    []Registry    // Additional registries exported alongside Registry
 	FlushInterval time.Duration // Flush interval
-	DurationUnit  time.Duration // Time conversion unit for durations
+	DurationUnit  time.Duration // Unit timer durations are reported in, nanoseconds when zero
 	Prefix        string        // Prefix to be prepended to metric names
+	Percentiles   []float64     // Percentiles to export from timers and histograms, defaults to 50, 75, 95, 99 and 99.9
+	FlushDeadline time.Duration // Time after which a flush skips remaining metrics, or spills them, if nonzero
+	WriteTimeout  time.Duration // Time allowed for writing each flush, if nonzero
+
+	// MinFlushInterval, if nonzero, is the shortest FlushInterval Run
+	// honors, so a misconfigured interval such as a millisecond can't
+	// overwhelm the statsd server.  Shorter intervals are raised to it with
+	// a StatsdErrorConfig error passed to OnError.
+	MinFlushInterval time.Duration
+
+	// Transport is the network to dial, "udp" when empty.  Any network
+	// understood by net.Dial may be used, as well as "http" and "https",
+	// which POST each flush as a single request to the URL in Addr.  On
+	// stream networks, "tcp" and "unix" among them, every metric including
+	// the last of each packet is terminated by MetricDelimiter so they
+	// aren't run together.
+	Transport string
+
+	// TCPKeepAlive, if nonzero, enables keepalives at that period on TCP
+	// connections so firewalls don't drop them while idle.  Otherwise the
+	// operating system's defaults apply.
+	TCPKeepAlive time.Duration
+
+	// SocketSendBufferBytes, if nonzero, sets the size of the kernel's send
+	// buffer for the connection, SO_SNDBUF, so that bursts of UDP writes
+	// during a flush don't fail with ENOBUFS.  The kernel may round or cap
+	// it, as Linux does at net.core.wmem_max.
+	SocketSendBufferBytes int
+
+	// ValidateOnDial, if set, confirms TCP and unix stream connections are
+	// still open by waiting briefly for the server to close them after
+	// dialing, failing the dial if it does, so half-open connections to
+	// servers which accept and then hang up surface then rather than as
+	// write errors mid-flush.  Waiting delays the flush by 100ms, so each
+	// target is validated only on its first dial and the first after a
+	// flush to it fails.  Datagram transports aren't validated.
+	ValidateOnDial bool
+
+	// FanoutConcurrency, if nonzero, sends to each of Targets from its own
+	// goroutine, at most that many sending at once, so one slow target
+	// doesn't hold up flushes to the others.  Each target's packets are
+	// still sent in order.
+	FanoutConcurrency int
+
+	// Dialer connects to the statsd server, as through a SOCKS proxy, in
+	// place of net.Dial when Transport isn't "http" or "https".
+	Dialer func(network, addr string) (net.Conn, error)
+
+	// DialRetries, if nonzero, is how many more times each flush tries to
+	// dial a target before giving up on it until the next flush, waiting
+	// DialRetryBackoff, or 100ms if that's zero, before the first retry and
+	// twice as long before each after, so flushes soon after boot survive
+	// the statsd agent not being up yet.
+	DialRetries      int
+	DialRetryBackoff time.Duration
+
+	// HTTPClient sends flushes when Transport is "http" or "https".  When
+	// nil, a client with a timeout of WriteTimeout is used.
+	HTTPClient *http.Client
+
+	// Clock schedules flushes, times them and times DialRetries' backoff,
+	// SystemClock when nil.
+	Clock Clock
+
+	// FlushOnStart flushes as soon as Run is called rather than only after
+	// the first FlushInterval, so processes which exit sooner still report.
+	FlushOnStart bool
+
+	// FlushCoalesceWindow, if nonzero, coalesces calls to SyncReporter.Flush
+	// made within that long of the start of the last flush into it, so they
+	// return its error without sending again and callers flushing too often
+	// can't flood the statsd server.
+	FlushCoalesceWindow time.Duration
+
+	// RetryOnBufferFull retries writes which fail because the kernel's
+	// socket buffer is full, with ENOBUFS or EWOULDBLOCK as UDP writes may
+	// during bursts, after briefly waiting for it to drain, rather than
+	// failing the flush.
+	RetryOnBufferFull bool
+
+	// DNSCacheTTL, if nonzero, caches the address Addr's host resolves to
+	// for that long rather than resolving it anew for every flush.  It's
+	// resolved again early if a flush fails to connect or send and the
+	// cached address is kept if resolving fails.  LookupHost resolves hosts,
+	// net.LookupHost when nil.
+	DNSCacheTTL time.Duration
+	LookupHost  func(host string) ([]string, error)
+
+	// MaxBytesPerSecond limits the bytes sent to the statsd server, if
+	// nonzero, allowing bursts of up to a second's worth.  Metrics beyond
+	// the limit are dropped and counted as statsd.dropped in SelfRegistry.
+	MaxBytesPerSecond int
+
+	// SpillLines, if nonzero, keeps up to that many metrics a flush can't
+	// send for each target in a ring buffer, which the next flush sends
+	// first, to smooth out bursts.  Those are the metrics beyond
+	// MaxBytesPerSecond's budget, those left once FlushDeadline has passed,
+	// which are spilled rather than skipped, and those in packets the
+	// server's backpressure keeps from being written at all, because the
+	// socket buffer is full or WriteTimeout passes.  When it's full the
+	// oldest are dropped and counted as statsd.dropped.
+	SpillLines int
+
+	// SelfRegistry, if not nil, receives metrics about the exporter itself,
+	// including statsd.buffer.high-water, the most bytes buffered for a
+	// single packet in the last flush, and statsd.nil-metrics, counting the
+	// nil metrics, as malformed registries may hold, skipped.
+	SelfRegistry Registry
+
+	// PacketSize is the most bytes sent in a single packet, 512 when zero.
+	PacketSize int
+
+	// FlushEveryNMetrics, if nonzero, sends a packet as soon as it holds
+	// that many metrics, however few bytes they are, for servers that prefer
+	// smaller batches.
+	FlushEveryNMetrics int
+
+	// MaxMetricsPerFlush, if nonzero, limits the registered metrics sent by
+	// each flush, for huge registries on limited bandwidth.  Those with the
+	// highest MetricPriority are sent first and, of those of the priority
+	// which doesn't all fit, the next in turn after those last sent, so that
+	// they take turns and all are eventually sent.  All metrics are of equal
+	// priority when MetricPriority is nil.
+	MaxMetricsPerFlush int
+	MetricPriority     func(name string) int
+
+	// SortedOutput sends counters first, then gauges, healthchecks,
+	// histograms, meters and finally timers, each sorted by name, for
+	// readable packet captures and stable golden tests.
+	SortedOutput bool
+
+	// EmptyNamePlaceholder is the name metrics registered under the empty
+	// name, which would otherwise be sent as "prefix..count", are sent
+	// under.  When it's empty they're skipped and counted as
+	// statsd.empty-names in SelfRegistry.
+	EmptyNamePlaceholder string
+
+	// ChangedOnly skips counters, meters and timers which haven't changed
+	// since they were last sent.  Meters are compared by their counts and
+	// timers by their counts and samples, never by their moving averages,
+	// which keep decaying while they're idle.  Everything is sent on the
+	// first flush and on the flush after one which failed.
+	ChangedOnly bool
+
+	// GaugeDeadband, if positive, skips gauges whose values have changed by
+	// no more than it since they were last sent, to quiet jittery gauges.
+	// Like ChangedOnly, everything is sent on the first flush and on the
+	// flush after one which failed.
+	GaugeDeadband float64
+
+	// GaugeDeadbandPercent makes GaugeDeadband a percentage of the value
+	// last sent rather than an absolute amount.
+	GaugeDeadbandPercent bool
+
+	// GaugeSmoothingAlpha, if between 0 and 1, sends each gauge's
+	// exponentially weighted moving average across flushes, weighting its
+	// current value by GaugeSmoothingAlpha, rather than the value itself, to
+	// steady jittery gauges.  Integer gauges are then sent as floats.
+	GaugeSmoothingAlpha float64
+
+	// MetricDelimiter separates metrics within a single packet.  The zero
+	// value selects '\n', which is what Etsy's statsd expects.  It's
+	// replaced with an underscore in metrics' names and tags, so it mustn't
+	// be a character that's part of the line protocol or the TagFormat, such
+	// as ':', '|', ',' or ';'.
+	MetricDelimiter byte
+
+	// FloatFormat is the strconv.FormatFloat format, such as 'f', 'g' or
+	// 'e', of float values, always at the smallest precision that represents
+	// them exactly.  The zero value means 'f', which never uses exponents,
+	// while 'g' keeps very large and small values compact.
+	FloatFormat byte
+
+	// RegistryLabels are inserted between Prefix and the names of metrics
+	// from the Registries entry with the same index so that like-named
+	// metrics from different registries don't collide.  Missing or empty
+	// labels leave the names unchanged.
+	RegistryLabels []string
+
+	// Tags are added to every metric when TagFormat supports them.
+	Tags      map[string]string
+	TagFormat TagFormat
+
+	// Targets, if not empty, replace Addr and TagFormat, each receiving
+	// every metric with Tags encoded in its own TagFormat so that, say, both
+	// vanilla statsd and DogStatsD servers may be fed during a migration.
+	// Each metric is snapshotted once per flush for all of them.
+	Targets []StatsdTarget
+
+	// SkipInvalid leaves out tags which TagFormat can't carry as-is and
+	// returns an InvalidTag error from the flush rather than replacing the
+	// offending characters with underscores.
+	SkipInvalid bool
+
+	// TimerCountAsCounter sends the number of events timed since the last
+	// flush as a statsd counter, as counters are sent, rather than sending
+	// the timer's running count as a gauge.
+	TimerCountAsCounter bool
+
+	// RunHealthchecksBeforeFlush runs every healthcheck in each registry
+	// before it's exported so the reported health isn't stale.
+	RunHealthchecksBeforeFlush bool
+
+	// HealthcheckErrorTags adds the error of each failing healthcheck, as
+	// an "error" tag, to its healthy gauge when sent to targets whose
+	// TagFormat supports tags.  Errors vary, so this may create many series.
+	HealthcheckErrorTags bool
+
+	// BeforeFlush, if not nil, is called with Registry and then each of
+	// Registries just before it's exported, so that gauges computed on
+	// demand may be updated in time.
+	BeforeFlush func(r Registry)
+
+	// EmitSequence ends each flush with a gauge, named SequenceMetric under
+	// Prefix or statsd.sequence if that's empty, which counts flushes so
+	// gaps downstream reveal lost packets.
+	EmitSequence   bool
+	SequenceMetric string
+
+	// EmitRegistrySize sends a registry.size gauge under Prefix counting the
+	// metrics found in the registries each flush, to catch cardinality
+	// explosions.
+	EmitRegistrySize bool
+
+	// EmitSecondsSinceLastFlush sends a statsd.seconds_since_last_flush
+	// gauge under Prefix each flush, the time since the start of the last
+	// flush which succeeded, so dashboards can alert on stalled pipelines
+	// from the metrics themselves.  Nothing is sent until a flush succeeds.
+	EmitSecondsSinceLastFlush bool
+
+	// EmitFlushCount increments a statsd.flush_count counter under Prefix
+	// by one each flush.  Unlike EmitSequence's gauge it sums across hosts
+	// and intervals, so downstream can compute flush frequency and spot
+	// gaps.
+	EmitFlushCount bool
+
+	// DurationUnitFunc, if not nil, returns the time conversion unit for the
+	// timer registered under the given name, overriding DurationUnit unless
+	// it returns zero.
+	DurationUnitFunc func(name string) time.Duration
+
+	// DurationUnitSuffix, if set, appends the name of each timer's duration
+	// unit, such as "ms", to the names of its sub-metrics measured in it, as
+	// in "latency.mean.ms", so timers in different units can be told apart.
+	DurationUnitSuffix bool
+
+	// Collisions selects what's done when two metrics are sent under the
+	// same name in one flush, as when a timer "foo" and a counter "foo" from
+	// different unlabeled Registries both produce "foo.count".
+	Collisions CollisionPolicy
+
+	// GaugeConflicts selects what's done when a Gauge and a GaugeFloat64,
+	// as from different unlabeled Registries, would both be sent under the
+	// same name in one flush.
+	GaugeConflicts GaugeConflictPolicy
+
+	// PercentileMethod selects how timer percentiles are computed.
+	PercentileMethod PercentileMethod
+
+	// DedupPercentiles skips each timer percentile whose value equals that
+	// of the previous percentile, which is common for sparse timers.
+	DedupPercentiles bool
+
+	// ReportHistograms exports histograms, which are otherwise skipped, with
+	// their count, min, max, mean, standard deviation and percentiles.
+	ReportHistograms bool
+
+	// HistogramPercentiles are the percentiles exported from histograms,
+	// which often track sizes rather than latencies, Percentiles when nil.
+	// PercentileMethod and DedupPercentiles apply to them as to timers'.
+	HistogramPercentiles []float64
+
+	// RoundPercentiles rounds timer and histogram percentiles, once scaled
+	// by DurationUnit, to the nearest integer, for cleaner output where
+	// fractions of a unit mean nothing.
+	RoundPercentiles bool
+
+	// CompactPercentiles sends each timer's and histogram's percentiles in
+	// one line rather than one line each, their values in the order of
+	// Percentiles or HistogramPercentiles separated by colons, as in
+	// "foo.percentiles:12:15:31|g".  That's not standard statsd and only
+	// custom collectors understand it.  DedupPercentiles doesn't apply, as
+	// values are told apart only by their positions.
+	CompactPercentiles bool
+
+	// MeterReportMode selects which meter lines are sent, both the count
+	// and the rates by default.
+	MeterReportMode MeterReportMode
+
+	// CaseFold folds the case of metric names, including Prefix and any
+	// RegistryLabels, so that names differing only in case, as those taken
+	// from struct fields often do, are sent as one.
+	CaseFold CaseFold
+
+	// OnError is called with each error StatsdWithConfig encounters,
+	// including panics recovered from callbacks such as DurationUnitFunc or
+	// healthchecks, which are logged if it's nil.  A metric whose callback
+	// panics is skipped but the rest of the flush continues.  Errors are
+	// *StatsdErrors, whose Category tells what failed.
+	OnError func(error)
+
+	// Coalesce holds each flush's metrics back until its end and then sends
+	// one line per name, the last value of each gauge and the sum of each
+	// counter, rather than one per metric reported, as like-named metrics
+	// from unlabeled Registries otherwise are.
+	Coalesce bool
+
+	// GaugeMin and GaugeMax, if GaugeMin is less than GaugeMax, bound the
+	// values sent for gauges, as some servers reject extreme values.  Those
+	// out of range are sent as the nearer bound and counted as
+	// statsd.clamped in SelfRegistry.
+	GaugeMin, GaugeMax float64
+
+	// SampleRates sets the statsd sample rates of metrics by the names
+	// they're registered under or prefixes of them, the longest matching
+	// prefix winning.  Metrics with rates below 1 are sent only that often
+	// and the server scales counters up to compensate.  The rate is 1 for
+	// metrics matching no entry.  Sends skipped by sampling are counted as
+	// statsd.sampled-out in SelfRegistry.
+	SampleRates map[string]float64
+
+	// ReportCounterRate sends, for each counter, its change per second since
+	// the previous flush, or over FlushInterval for the first, as a rate
+	// gauge computed from the same reading of the counter as its count.
+	ReportCounterRate bool
+
+	// ReportTimerCountRate sends, for each timer, the events it's timed per
+	// second since the previous flush as a count-rate gauge, computed from
+	// its count and the clock rather than its moving averages.  Nothing is
+	// sent by the first flush.
+	ReportTimerCountRate bool
+
+	// ReportSampleSize sends, for each timer, the number of values in the
+	// sample its percentiles are computed from as a sample-size gauge.  A
+	// uniform sample holds every value up to its reservoir size and an
+	// exponentially-decaying one favors recent values, so percentiles from
+	// small samples, as of low-traffic timers, deserve less confidence.
+	ReportSampleSize bool
+
+	// ReportSum and ReportVariance send, for each histogram and timer, the
+	// sum and variance of the values in its sample as sum and variance
+	// gauges, from which downstream systems can recompute aggregates.
+	// Timers' are scaled by DurationUnit, their variances by its square.
+	ReportSum      bool
+	ReportVariance bool
+
+	// GaugeRateMetrics names gauges, such as cumulative byte totals, whose
+	// per-second change since the last flush is also sent, as a rate
+	// gauge, to turn them into throughputs.  Nothing is sent by the first
+	// flush.
+	GaugeRateMetrics []string
+
+	// SkipUnsetGauges skips gauges, such as TrackedGauges, which report
+	// through an IsSet method that they've never been updated, rather than
+	// sending their initial zeros.  Gauges set to zero are still sent.
+	SkipUnsetGauges bool
+
+	// MaxTagCardinality, if nonzero, caps the distinct combinations of tags
+	// appended to each metric's name by TaggedName, as from contexts, that
+	// are sent, to protect the backend from cardinality explosions.  Each
+	// metric name is capped on its own, so one metric's explosion doesn't
+	// drop another's tags.  Metrics with combinations beyond the first that
+	// many seen for their name are sent without their tags and counted as
+	// statsd.tag-cardinality-dropped in SelfRegistry.
+	MaxTagCardinality int
+
+	// TimerDistributions, to targets whose TagFormat is TagFormatDatadog,
+	// also sends the values of DistributionTimers as DogStatsD
+	// distributions under the timers' own names so that Datadog computes
+	// percentiles across hosts.  Each flush sends the value of every event
+	// timed since the last, up to the number each timer keeps.  Other
+	// timers, which keep only a sample, send no distributions.
+	TimerDistributions bool
+
+	// UseTimingType sends timers' min and max as statsd timings, as in
+	// "foo.min:3|ms", rather than gauges, so the server aggregates them as
+	// timing observations.  They're scaled by DurationUnit like gauges but
+	// statsd takes timings to be milliseconds, so it's usually
+	// time.Millisecond.
+	UseTimingType bool
+
+	// UseMeterType sends counters as statsd meters, as in "foo.count:3|m",
+	// rather than counters, for servers such as statsite which distinguish
+	// the two.  Servers which don't understand meters drop or reject them.
+	UseMeterType bool
+
+	// CounterDeltas sends counters as their change since the previous
+	// flush, which is what statsd sums, rather than as their running
+	// totals.  Dashboards built on the totals sent by default see the
+	// deltas instead, so it's off unless set.
+	CounterDeltas bool
+
+	// NegativeCounters selects how counters are sent whose values are
+	// negative, which with CounterDeltas are those decremented since the
+	// last flush.
+	NegativeCounters NegativeCounterPolicy
+
+	// ResetCounters subtracts what's sent of each counter from it, so that
+	// counters in the registry count only what's yet to be sent, as statsd's
+	// own counters are reset at every flush.  Increments made while the
+	// counter is being sent are kept for the next flush.  Nothing is
+	// subtracted unless every target is sent to, so counts are sent again
+	// after a failed flush, to any target which did receive them as well.
+	ResetCounters bool
+
+	// Aliases maps the registered names of metrics to additional names,
+	// as legacy names still referenced by dashboards, under which they're
+	// also exported.
+	Aliases map[string]string
+
+	// AliasesOnly exports aliased metrics under their aliases alone rather
+	// than under both names.
+	AliasesOnly bool
+}
+
+// NegativeCounterPolicy selects how negative counter values, the deltas of
+// counters sent with CounterDeltas and otherwise their totals, are sent.
+type NegativeCounterPolicy int
+
+const (
+	// NegativeCounterSend sends negative values as negative counter
+	// increments, as in "foo.count:-1|c", which etsy's statsd sums like any
+	// other but some servers reject.
+	NegativeCounterSend NegativeCounterPolicy = iota
+
+	// NegativeCounterGaugeDelta sends every counter's delta, negative or
+	// not and whether or not CounterDeltas is set, as a signed gauge delta,
+	// as in "foo.count:-1|g" or "foo.count:+2|g", so that the statsd gauge
+	// tracks the counter's total.
+	NegativeCounterGaugeDelta
+
+	// NegativeCounterDrop doesn't send negative values at all, so the
+	// decrements are lost but every counter line is positive.
+	NegativeCounterDrop
+
+	// NegativeCounterReset takes a counter whose count has fallen since the
+	// last flush to have been cleared and counted up again, so sends its
+	// whole count as the delta, and counts such resets as
+	// statsd.counter-resets in SelfRegistry.  Counters which are
+	// decremented are misreported.  Without CounterDeltas, negative totals
+	// are sent as they are.
+	NegativeCounterReset
+)
+
+// CaseFold selects how the case of metric names is normalized.
+type CaseFold int
+
+const (
+	// CaseFoldNone leaves metric names untouched.
+	CaseFoldNone CaseFold = iota
+
+	// CaseFoldLower lowercases metric names.
+	CaseFoldLower
+
+	// CaseFoldUpper uppercases metric names.
+	CaseFoldUpper
+)
+
+// MeterReportMode selects which lines are sent for each meter.
+type MeterReportMode int
+
+const (
+	// MeterReportBoth sends the count and the rates.
+	MeterReportBoth MeterReportMode = iota
+
+	// MeterReportRates sends only the one-, five- and fifteen-minute and
+	// mean rates.
+	MeterReportRates
+
+	// MeterReportCount sends only the count.
+	MeterReportCount
+)
+
+// StatsdTarget is a statsd server and the format it understands tags in.
+type StatsdTarget struct {
+	Addr      string
+	TagFormat TagFormat
+}
+
+// CollisionPolicy selects how metric name collisions are handled.
+type CollisionPolicy int
+
+const (
+	// CollisionIgnore sends every metric regardless of its name.
+	CollisionIgnore CollisionPolicy = iota
+
+	// CollisionLog sends every metric and logs each name sent twice.
+	CollisionLog
+
+	// CollisionError sends only the first metric under each name and
+	// returns a MetricNameCollision error from the flush.
+	CollisionError
+)
+
+// GaugeConflictPolicy selects which of a Gauge and a GaugeFloat64 sharing a
+// name are sent.
+type GaugeConflictPolicy int
+
+const (
+	// GaugeConflictBoth sends both, leaving the Collisions policy to apply.
+	GaugeConflictBoth GaugeConflictPolicy = iota
+
+	// GaugeConflictPreferFloat sends only the GaugeFloat64.
+	GaugeConflictPreferFloat
+
+	// GaugeConflictPreferInt sends only the Gauge.
+	GaugeConflictPreferInt
+
+	// GaugeConflictError sends neither and returns a MetricNameCollision
+	// error from the flush.
+	GaugeConflictError
+)
+
+// MetricNameCollision is the error returned when two metrics would be sent
+// under the same name.
+type MetricNameCollision string
+
+func (err MetricNameCollision) Error() string {
+	return fmt.Sprintf("metric name collision: %s", string(err))
+}
+
+// PercentileMethod selects how percentiles are computed from a sample.
+type PercentileMethod int
+
+const (
+	// PercentileInterpolated linearly interpolates between the two sampled
+	// values nearest the requested rank, as Timer.Percentiles does.  Scores
+	// vary smoothly but may be values that were never observed.
+	PercentileInterpolated PercentileMethod = iota
+
+	// PercentileNearestRank reports the smallest sampled value at or above
+	// the requested rank, matching most other statsd tooling.  Scores are
+	// always observed values but jump between them for small samples.
+	// Timers whose snapshots don't expose their sample fall back to
+	// PercentileInterpolated.
+	PercentileNearestRank
+)
+
+// Statsd is a blocking exporter function which reports metrics in r
+// to a statsd server located at addr, flushing them every d duration
+// and prepending metric names with prefix.
+func Statsd(r Registry, d time.Duration, prefix string, addr string) {
+	StatsdWithConfig(StatsdConfig{
+		Addr:          addr,
+		Registry:      r,
+		FlushInterval: d,
+		DurationUnit:  time.Nanosecond,
+		Prefix:        prefix,
+	})
+}
+
+// StatsdWithConfig is a blocking exporter function just like Statsd,
+// but it takes a StatsdConfig instead.
+func StatsdWithConfig(c StatsdConfig) {
+	NewStatsdReporter(c).Run()
+}
+
+// StatsdReporter exports the registries named by a StatsdConfig and holds
+// the state kept from one flush to the next.  Its setters may be called
+// while it runs and take effect from the next flush.
+type StatsdReporter struct {
+	c            StatsdConfig
+	bytesSent    int64
+	clamped      Counter
+	counterFold  CaseFold
+	counterLines map[statsdMetricID]*statsdCounterLine
+	counts       map[string]int64
+	cursors      map[int]int
+	dropped      Counter
+	elapsed      time.Duration
+	emptyNames   Counter
+	fingerprints map[string][4]float64
+	flushes      int64
+	flushing     sync.Mutex
+	workers      chan struct{}
+	gaugeRates   map[string]float64
+	gauges       map[string]float64
+	highWater    Gauge
+	lastErr      error
+	lastFlush    time.Time
+	lastSuccess  time.Time
+	limiter      *byteLimiter
+	mutex        sync.Mutex
+	nilMetrics   Counter
+	resets       Counter
+	resolved     map[string]statsdResolved
+	sampledOut   Counter
+	sequence     int64
+	smoothed     map[string]float64
+	spills       map[StatsdTarget]*statsdSpill
+	stop         chan struct{}
+	stopOnce     sync.Once
+	tagCombos    map[string]map[string]bool
+	tagsDropped  Counter
+	validated    map[StatsdTarget]bool
+}
+
+// NewStatsdReporter constructs a new StatsdReporter.  Its DurationUnit is
+// time.Nanosecond if c's is zero, as Statsd's is.
+func NewStatsdReporter(c StatsdConfig) *StatsdReporter {
+	if 0 == c.DurationUnit {
+		c.DurationUnit = time.Nanosecond
+	}
+	r := &StatsdReporter{
+		c:            c,
+		clamped:      NilCounter{},
+		counterLines: make(map[statsdMetricID]*statsdCounterLine),
+		counts:       make(map[string]int64),
+		cursors:      make(map[int]int),
+		dropped:      NilCounter{},
+		emptyNames:   NilCounter{},
+		fingerprints: make(map[string][4]float64),
+		gaugeRates:   make(map[string]float64),
+		gauges:       make(map[string]float64),
+		highWater:    NilGauge{},
+		nilMetrics:   NilCounter{},
+		resets:       NilCounter{},
+		resolved:     make(map[string]statsdResolved),
+		sampledOut:   NilCounter{},
+		smoothed:     make(map[string]float64),
+		spills:       make(map[StatsdTarget]*statsdSpill),
+		stop:         make(chan struct{}),
+		tagCombos:    make(map[string]map[string]bool),
+		tagsDropped:  NilCounter{},
+		validated:    make(map[StatsdTarget]bool),
+	}
+	if nil != c.SelfRegistry {
+		r.clamped = GetOrRegisterCounter("statsd.clamped", c.SelfRegistry)
+		r.dropped = GetOrRegisterCounter("statsd.dropped", c.SelfRegistry)
+		r.emptyNames = GetOrRegisterCounter("statsd.empty-names", c.SelfRegistry)
+		r.highWater = GetOrRegisterGauge("statsd.buffer.high-water", c.SelfRegistry)
+		r.nilMetrics = GetOrRegisterCounter("statsd.nil-metrics", c.SelfRegistry)
+		r.resets = GetOrRegisterCounter("statsd.counter-resets", c.SelfRegistry)
+		r.sampledOut = GetOrRegisterCounter("statsd.sampled-out", c.SelfRegistry)
+		r.tagsDropped = GetOrRegisterCounter("statsd.tag-cardinality-dropped", c.SelfRegistry)
+	}
+	if 0 < c.MaxBytesPerSecond {
+		r.limiter = newByteLimiter(c.clock(), c.MaxBytesPerSecond)
+	}
+	if 0 < c.FanoutConcurrency {
+		r.workers = make(chan struct{}, c.FanoutConcurrency)
+	}
+	return r
+}
+
+// Run flushes every FlushInterval, or MinFlushInterval if that's longer,
+// passing errors to OnError, until Stop is called.
+func (r *StatsdReporter) Run() {
+	c := r.config()
+	if c.FlushOnStart {
+		if err := r.flush(); nil != err {
+			c.onError(err)
+		}
+	}
+	interval := c.flushInterval()
+	ticker := c.newTicker(interval)
+	for {
+		select {
+		case <-ticker.C():
+		case <-r.stop:
+			ticker.Stop()
+			return
+		}
+		c := r.config()
+		if err := r.flush(); nil != err {
+			c.onError(err)
+		}
+		if c = r.config(); interval != c.flushInterval() {
+			ticker.Stop()
+			interval = c.flushInterval()
+			ticker = c.newTicker(interval)
+		}
+	}
+}
+
+// Stop makes Run return once any flush in progress finishes.  It may be
+// called more than once.
+func (r *StatsdReporter) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+}
+
+// SyncReporter exports the registries named by a StatsdConfig only when
+// told to, with no goroutine of its own, for deterministic tests and batch
+// jobs.
+type SyncReporter struct {
+	mutex sync.Mutex
+	r     *StatsdReporter
+}
+
+// SyncStatsd constructs a new SyncReporter.  Its FlushInterval is unused.
+func SyncStatsd(c StatsdConfig) *SyncReporter {
+	return &SyncReporter{r: NewStatsdReporter(c)}
+}
+
+// Flush sends every metric to the statsd server and returns once they've
+// been sent, unless it's coalesced into the last flush by
+// FlushCoalesceWindow.  Concurrent calls flush one at a time.
+func (s *SyncReporter) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c := s.r.config()
+	if 0 < c.FlushCoalesceWindow {
+		s.r.mutex.Lock()
+		lastErr, lastFlush := s.r.lastErr, s.r.lastFlush
+		s.r.mutex.Unlock()
+		if !lastFlush.IsZero() && c.clock().Now().Sub(lastFlush) < c.FlushCoalesceWindow {
+			return lastErr
+		}
+	}
+	return s.r.flush()
+}
+
+// SetFlushInterval changes the interval between flushes.
+func (r *StatsdReporter) SetFlushInterval(d time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.c.FlushInterval = d
+}
+
+// SetMinFlushInterval changes the shortest interval between flushes.
+func (r *StatsdReporter) SetMinFlushInterval(d time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.c.MinFlushInterval = d
+}
+
+// SetPrefix changes the prefix prepended to metric names.
+func (r *StatsdReporter) SetPrefix(prefix string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.c.Prefix = prefix
+}
+
+// SetTags replaces the tags added to every metric with a copy of tags.
+func (r *StatsdReporter) SetTags(tags map[string]string) {
+	copied := make(map[string]string, len(tags))
+	for key, value := range tags {
+		copied[key] = value
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.c.Tags = copied
+}
+
+// config returns a copy of the reporter's current configuration.
+func (r *StatsdReporter) config() StatsdConfig {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.c
+}
+
+// flush sends every metric in the configured registries to the statsd
+// server.  Concurrent calls flush one at a time.
+func (r *StatsdReporter) flush() (err error) {
+	r.flushing.Lock()
+	defer r.flushing.Unlock()
+	config := r.config()
+	c := &config
+	clock := c.clock()
+	start := clock.Now()
+	seen, skipped := 0, 0
+	r.sequence++
+	r.mutex.Lock()
+	if r.elapsed = 0; !r.lastFlush.IsZero() {
+		r.elapsed = start.Sub(r.lastFlush)
+	}
+	lastSuccess := r.lastSuccess
+	r.mutex.Unlock()
+	var sent int64
+	defer func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.bytesSent += sent
+		r.flushes++
+		r.lastErr = err
+		r.lastFlush = start
+		if nil == err {
+			r.lastSuccess = start
+		}
+	}()
+
+	targets := c.Targets
+	if 0 == len(targets) {
+		targets = []StatsdTarget{{c.Addr, c.TagFormat}}
+	}
+	var (
+		connErrs StatsdErrors
+		spilled  int
+		ss       statsdClients
+		tagErr   error
+	)
+	for _, target := range targets {
+		s, err := r.dialWithRetries(c, target)
+		if nil != err {
+			r.fingerprints = make(map[string][4]float64)
+			r.gauges = make(map[string]float64)
+			connErrs = append(connErrs, &StatsdError{StatsdErrorDial, err})
+			continue
+		}
+		if nil != s.tagErr && nil == tagErr {
+			tagErr = s.tagErr
+		}
+		ss = append(ss, s)
+	}
+	if 0 == len(ss) {
+		return connErrs.errorOrNil()
+	}
+
+	// Counters sent by reportCounter are handed back to report once they're
+	// configured to need more than it does, with the counts it last sent.
+	if !c.plainCounters() && 0 < len(r.counterLines) {
+		for _, line := range r.counterLines {
+			r.counts[line.state] = line.count
+		}
+		r.counterLines = make(map[statsdMetricID]*statsdCounterLine)
+	}
+
+	var resets []counterReset
+	report := func(scope, prefix, name string, i interface{}) {
+		if 0 < c.FlushDeadline && c.FlushDeadline < clock.Now().Sub(start) {
+			if 0 == c.SpillLines {
+				skipped++
+				return
+			}
+			if 0 == spilled {
+				ss.spillRest()
+			}
+			spilled++
+		}
+		defer c.recoverPanic("reporting", name)
+		name, tags := splitTaggedName(name)
+		if "" == name {
+			if "" == c.EmptyNamePlaceholder {
+				r.emptyNames.Inc(1)
+				return
+			}
+			name = c.EmptyNamePlaceholder
+		}
+		// Counters are reset and timers' values taken once for all the
+		// names they're reported under.  Counters are only reset once
+		// they've been sent, so a failed flush sends them again next time.
+		if counter, ok := i.(Counter); ok && c.ResetCounters {
+			count := counter.Count()
+			resets = append(resets, counterReset{counter, count})
+			i = CounterSnapshot(count)
+		}
+		if vt, ok := i.(valueTaker); ok && c.TimerDistributions {
+			if t, ok := i.(Timer); ok {
+				i = takenTimer{t, vt.TakeValues()}
+			}
+		}
+		alias, ok := c.Aliases[name]
+		if !ok || !c.AliasesOnly {
+			r.reportTagged(c, ss, scope, prefix, name, tags, i)
+		}
+		if ok {
+			r.reportTagged(c, ss, scope, prefix, alias, tags, i)
+		}
+	}
+
+	var held []statsdMetric
+	hold := 0 < c.MaxMetricsPerFlush || GaugeConflictBoth != c.GaugeConflicts || c.SortedOutput
+	flush := func(scope, prefix string, registry Registry) {
+		if nil != c.BeforeFlush {
+			func() {
+				defer c.recoverPanic("running", "BeforeFlush")
+				c.BeforeFlush(registry)
+			}()
+		}
+		if c.RunHealthchecksBeforeFlush {
+			func() {
+				defer c.recoverPanic("running", "healthchecks")
+				registry.RunHealthchecks()
+			}()
+		}
+		eachSnapshot(registry, func(name string, i interface{}) {
+			seen++
+			if isNilMetric(i) {
+				r.nilMetrics.Inc(1)
+				return
+			}
+			if hold {
+				m := statsdMetric{scope: scope, prefix: prefix, name: name, metric: i}
+				if nil != c.MetricPriority {
+					m.priority = c.MetricPriority(name)
+				}
+				held = append(held, m)
+				return
+			}
+			report(scope, prefix, name, i)
+		})
+	}
+
+	if nil != c.Registry {
+		flush("", c.Prefix, c.Registry)
+	}
+	for idx, registry := range c.Registries {
+		prefix := c.Prefix
+		if idx < len(c.RegistryLabels) && "" != c.RegistryLabels[idx] {
+			prefix = BuildMetricName(prefix, c.RegistryLabels[idx], "", ".")
+		}
+		flush(strconv.Itoa(idx)+":", prefix, registry)
+	}
+	held, conflictErr := c.resolveGaugeConflicts(held)
+	if 0 < c.MaxMetricsPerFlush {
+		held = r.ration(c.MaxMetricsPerFlush, held)
+	}
+	if c.SortedOutput {
+		sort.Slice(held, func(i, j int) bool {
+			if ri, rj := typeRank(held[i].metric), typeRank(held[j].metric); ri != rj {
+				return ri < rj
+			}
+			if held[i].name != held[j].name {
+				return held[i].name < held[j].name
+			}
+			return held[i].scope < held[j].scope
+		})
+	}
+	for _, m := range held {
+		report(m.scope, m.prefix, m.name, m.metric)
+	}
+
+	if c.EmitRegistrySize {
+		ss.GaugeInt64(c.foldCase(BuildMetricName(c.Prefix, "registry.size", "", ".")), int64(seen), 1)
+	}
+
+	if c.EmitSequence {
+		name := c.SequenceMetric
+		if "" == name {
+			name = "statsd.sequence"
+		}
+		ss.GaugeInt64(c.foldCase(BuildMetricName(c.Prefix, name, "", ".")), r.sequence, 1)
+	}
+
+	if c.EmitFlushCount {
+		ss.Increment(c.foldCase(BuildMetricName(c.Prefix, "statsd.flush_count", "", ".")), 1, 1)
+	}
+
+	if c.EmitSecondsSinceLastFlush && !lastSuccess.IsZero() {
+		ss.GaugeFloat64(c.foldCase(BuildMetricName(c.Prefix, "statsd.seconds_since_last_flush", "", ".")), start.Sub(lastSuccess).Seconds(), 1)
+	}
+
+	closeErrs := make([]error, len(ss))
+	if nil != r.workers {
+		var wg sync.WaitGroup
+		for idx, s := range ss {
+			wg.Add(1)
+			go func(idx int, s *client) {
+				defer wg.Done()
+				closeErrs[idx] = s.Close()
+			}(idx, s)
+		}
+		wg.Wait()
+	} else {
+		for idx, s := range ss {
+			closeErrs[idx] = s.Close()
+		}
+	}
+	var (
+		collisionErr error
+		highWater    int
+	)
+	for idx, s := range ss {
+		if err := closeErrs[idx]; nil != err {
+			r.fingerprints = make(map[string][4]float64)
+			r.gauges = make(map[string]float64)
+			r.expireResolved(s.target)
+			delete(r.validated, s.target)
+			connErrs = append(connErrs, &StatsdError{StatsdErrorWrite, err})
+		}
+		if highWater < s.highWater {
+			highWater = s.highWater
+		}
+		sent += s.sent
+		if nil != s.collisionErr && nil == collisionErr {
+			collisionErr = s.collisionErr
+		}
+	}
+	r.highWater.Update(int64(highWater))
+	if nil == collisionErr {
+		collisionErr = conflictErr
+	}
+	if err := connErrs.errorOrNil(); nil != err {
+		return err
+	}
+	for _, reset := range resets {
+		reset.counter.Dec(reset.count)
+	}
+	if nil != tagErr {
+		return &StatsdError{StatsdErrorConfig, tagErr}
+	}
+	if nil != collisionErr {
+		return &StatsdError{StatsdErrorEncode, collisionErr}
+	}
+	if 0 < skipped {
+		return &StatsdError{StatsdErrorFlush, fmt.Errorf("deadline of %v exceeded, skipped %d metrics", c.FlushDeadline, skipped)}
+	}
+	if 0 < spilled {
+		return &StatsdError{StatsdErrorFlush, fmt.Errorf("deadline of %v exceeded, spilled %d metrics", c.FlushDeadline, spilled)}
+	}
+	return nil
+}
+
+// statsdMetricID identifies a metric reported, by the scope of the state kept
+// for it, the prefix it's sent under and the name it's registered under.
+type statsdMetricID struct {
+	scope, prefix, name string
+}
+
+// statsdCounterLine is what's kept of a counter sent by reportCounter: the
+// name it's sent under, the name its state is kept under and its count and
+// that count formatted as a statsd counter, as in "1|c".
+type statsdCounterLine struct {
+	stat, state string
+	count       int64
+	format      string
+}
+
+// counterReset is a counter sent under ResetCounters and the count sent,
+// which is subtracted from it once the flush has succeeded.
+type counterReset struct {
+	counter Counter
+	count   int64
+}
+
+// statsdMetric is a registered metric held back to be rationed.
+type statsdMetric struct {
+	scope, prefix, name string
+	metric              interface{}
+	priority            int
+}
+
+// resolveGaugeConflicts returns the given metrics less the Gauges or
+// GaugeFloat64s c.GaugeConflicts drops of those which share names, and under
+// GaugeConflictError a MetricNameCollision naming the first.
+func (c *StatsdConfig) resolveGaugeConflicts(metrics []statsdMetric) ([]statsdMetric, error) {
+	if GaugeConflictBoth == c.GaugeConflicts {
+		return metrics, nil
+	}
+	ints, floats := make(map[string]bool), make(map[string]bool)
+	for _, m := range metrics {
+		switch m.metric.(type) {
+		case Info:
+		case Gauge:
+			ints[c.foldCase(BuildMetricName(m.prefix, m.name, "", "."))] = true
+		case GaugeFloat64:
+			floats[c.foldCase(BuildMetricName(m.prefix, m.name, "", "."))] = true
+		}
+	}
+	var (
+		err  error
+		kept = metrics[:0]
+	)
+	for _, m := range metrics {
+		key := c.foldCase(BuildMetricName(m.prefix, m.name, "", "."))
+		if ints[key] && floats[key] {
+			drop := false
+			switch m.metric.(type) {
+			case Info:
+			case Gauge:
+				drop = GaugeConflictPreferInt != c.GaugeConflicts
+			case GaugeFloat64:
+				drop = GaugeConflictPreferFloat != c.GaugeConflicts
+			}
+			if GaugeConflictError == c.GaugeConflicts && nil == err {
+				err = MetricNameCollision(key + ".value")
+			}
+			if drop {
+				continue
+			}
+		}
+		kept = append(kept, m)
+	}
+	return kept, err
+}
+
+// gaugeSetter is implemented by gauges, such as TrackedGauges, which
+// record whether they've ever been updated.
+type gaugeSetter interface {
+	IsSet() bool
+}
+
+// valueTaker is implemented by timers, such as DistributionTimers, which
+// keep the values of the events timed since they were last taken.
+type valueTaker interface {
+	TakeValues() []int64
+}
+
+// takenTimer is a timer whose values have been taken once for all the names
+// it's reported under.
+type takenTimer struct {
+	Timer
+	values []int64
+}
+
+// TakeValues returns the values taken from the timer.
+func (t takenTimer) TakeValues() []int64 {
+	return t.values
+}
+
+// isNilMetric reports whether i is nil or a nil pointer, as malformed
+// registries may hold, which would panic if reported.
+func isNilMetric(i interface{}) bool {
+	if nil == i {
+		return true
+	}
+	switch v := reflect.ValueOf(i); v.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+		return v.IsNil()
+	}
+	return false
+}
+
+// typeRank returns the position of the metric's type in SortedOutput's
+// order.
+func typeRank(i interface{}) int {
+	switch i.(type) {
+	case Counter:
+		return 0
+	case Gauge, GaugeFloat64:
+		return 1
+	case Healthcheck:
+		return 2
+	case Histogram:
+		return 3
+	case Meter:
+		return 4
+	case Timer:
+		return 5
+	}
+	return 6
+}
+
+// ration returns at most max of the given metrics, those of the highest
+// priority first and, of those of the priority which don't all fit, the next
+// in turn, by name, after those returned last time.
+func (r *StatsdReporter) ration(max int, metrics []statsdMetric) []statsdMetric {
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].priority != metrics[j].priority {
+			return metrics[i].priority > metrics[j].priority
+		}
+		if metrics[i].scope != metrics[j].scope {
+			return metrics[i].scope < metrics[j].scope
+		}
+		return metrics[i].name < metrics[j].name
+	})
+	start := 0
+	for {
+		if start == len(metrics) {
+			return metrics
+		}
+		end := start
+		for end < len(metrics) && metrics[start].priority == metrics[end].priority {
+			end++
+		}
+		if max < end {
+			group := metrics[start:end]
+			rationed := make([]statsdMetric, start, max)
+			copy(rationed, metrics)
+			cursor := r.cursors[group[0].priority] % len(group)
+			for k := 0; k < max-start; k++ {
+				rationed = append(rationed, group[(cursor+k)%len(group)])
+			}
+			r.cursors[group[0].priority] = (cursor + max - start) % len(group)
+			return rationed
+		}
+		start = end
+	}
+}
+
+// dialWithRetries dials the given target as by dial, retrying with backoff,
+// timed by c's Clock, up to c.DialRetries times while that fails.
+func (r *StatsdReporter) dialWithRetries(c *StatsdConfig, target StatsdTarget) (*client, error) {
+	s, err := r.dial(c, target)
+	backoff := c.DialRetryBackoff
+	if 0 == backoff {
+		backoff = 100 * time.Millisecond
+	}
+	for retry := 0; nil != err && retry < c.DialRetries; retry++ {
+		ticker := c.clock().NewTicker(backoff)
+		<-ticker.C()
+		ticker.Stop()
+		backoff *= 2
+		s, err = r.dial(c, target)
+	}
+	return s, err
+}
+
+// dial connects to the given target and returns a new client configured by
+// c for it, whose tagErr is set if c.Tags can't all be encoded as-is.
+func (r *StatsdReporter) dial(c *StatsdConfig, target StatsdTarget) (*client, error) {
+	tc := *c
+	tc.TagFormat = target.TagFormat
+	tc.ValidateOnDial = c.ValidateOnDial && !r.validated[target]
+	addr, err := r.resolve(c, target.Addr)
+	if nil != err {
+		return nil, err
+	}
+	tc.Addr = addr
+	s, err := tc.dial()
+	if nil != err {
+		r.expireResolved(target)
+		return nil, err
+	}
+	if tc.ValidateOnDial {
+		r.validated[target] = true
+	}
+	s.target = target
+	s.tagFormat = target.TagFormat
+	if nil != r.workers {
+		s.conn = newFanoutConn(s.conn, r.workers)
+	}
+	s.dropped = r.dropped
+	s.limiter = r.limiter
+	s.sampledOut = r.sampledOut
+	if 0 < c.SpillLines {
+		spill := r.spills[target]
+		if nil == spill || c.SpillLines != len(spill.lines) {
+			spill = newStatsdSpill(c.SpillLines, spill)
+			r.spills[target] = spill
+		}
+		s.spill = spill
+		s.drainSpill()
+	}
+	if TagFormatGraphite == target.TagFormat {
+		s.nameTags, s.tagErr = encodeTags(c.Tags, target.TagFormat, c.SkipInvalid)
+	} else {
+		s.tags, s.tagErr = encodeTags(c.Tags, target.TagFormat, c.SkipInvalid)
+	}
+	if c.Coalesce {
+		s.coalesced = make(map[string]int)
+	}
+	if CollisionIgnore != c.Collisions {
+		s.collisions = c.Collisions
+		s.names = make(map[string]bool)
+	}
+	return s, nil
+}
+
+// keepAliver is implemented by connections, such as *net.TCPConn, which
+// may send keepalives.
+type keepAliver interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// setKeepAlive enables keepalives every d on conn if it supports them.
+func setKeepAlive(conn net.Conn, d time.Duration) error {
+	k, ok := conn.(keepAliver)
+	if !ok {
+		return nil
+	}
+	if err := k.SetKeepAlive(true); nil != err {
+		return err
+	}
+	return k.SetKeepAlivePeriod(d)
+}
+
+// writeBufferSetter is implemented by connections, such as *net.UDPConn and
+// *net.TCPConn, whose kernel send buffers may be resized.
+type writeBufferSetter interface {
+	SetWriteBuffer(bytes int) error
+}
+
+// setWriteBuffer sets the size of conn's send buffer if it supports that.
+func setWriteBuffer(conn net.Conn, bytes int) error {
+	w, ok := conn.(writeBufferSetter)
+	if !ok {
+		return nil
+	}
+	return w.SetWriteBuffer(bytes)
+}
+
+// statsdValidateWait is how long ValidateOnDial waits for the server to
+// close a new connection.
+const statsdValidateWait = 100 * time.Millisecond
+
+// isStream returns whether the transport is a stream, whose metrics must
+// each be terminated so they aren't run together.
+func isStream(transport string) bool {
+	switch transport {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return true
+	}
+	return false
+}
+
+// validateConn waits up to d for the server to close or reset conn, which
+// statsd servers never write to, returning an error if it does.
+func validateConn(conn net.Conn, d time.Duration) error {
+	if err := conn.SetReadDeadline(time.Now().Add(d)); nil != err {
+		return err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	_, err := conn.Read(make([]byte, 1))
+	if io.EOF == err {
+		return fmt.Errorf("%s closed the connection", conn.RemoteAddr())
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return nil
+	}
+	return err
+}
+
+// statsdResolved is the address a statsd server's address last resolved to.
+type statsdResolved struct {
+	resolved string
+	expires  time.Time
+}
+
+// resolve returns the address to dial in place of addr, a cached address it
+// resolves to if c.DNSCacheTTL is set.
+func (r *StatsdReporter) resolve(c *StatsdConfig, addr string) (string, error) {
+	if 0 >= c.DNSCacheTTL || "http" == c.Transport || "https" == c.Transport {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if nil != err || nil != net.ParseIP(host) {
+		return addr, nil
+	}
+	now := c.clock().Now()
+	resolved, cached := r.resolved[addr]
+	if cached && now.Before(resolved.expires) {
+		return resolved.resolved, nil
+	}
+	lookupHost := c.LookupHost
+	if nil == lookupHost {
+		lookupHost = net.LookupHost
+	}
+	addrs, err := lookupHost(host)
+	if nil == err && 0 == len(addrs) {
+		err = fmt.Errorf("no addresses found for %s", host)
+	}
+	if nil != err {
+		if cached {
+			return resolved.resolved, nil
+		}
+		return "", err
+	}
+	resolved = statsdResolved{
+		resolved: net.JoinHostPort(addrs[0], port),
+		expires:  now.Add(c.DNSCacheTTL),
+	}
+	r.resolved[addr] = resolved
+	return resolved.resolved, nil
+}
+
+// expireResolved forces the target's address to be resolved again, keeping
+// the cached address in case that fails.
+func (r *StatsdReporter) expireResolved(target StatsdTarget) {
+	if resolved, ok := r.resolved[target.Addr]; ok {
+		resolved.expires = time.Time{}
+		r.resolved[target.Addr] = resolved
+	}
+}
+
+// report sends the metric i, registered under the given name, to the statsd
+// clients s under the given prefix as configured by c.  The state kept for it
+// from one flush to the next is further scoped so that like-named metrics
+// from different registries don't share it.
+func (r *StatsdReporter) report(c *StatsdConfig, s statsdClients, scope, prefix, name string, i interface{}) {
+	if counter, ok := i.(Counter); ok && c.plainCounters() {
+		r.reportCounter(c, s, scope, prefix, name, counter.Count())
+		return
+	}
+	key := c.foldCase(BuildMetricName(prefix, name, "", "."))
+	state := scope + key
+	rate := c.sampleRate(name)
+	switch metric := i.(type) {
+	case Counter:
+		count := metric.Count()
+		if !r.changed(c, state, [4]float64{float64(count)}) && (!c.ResetCounters || 0 == count) {
+			return
+		}
+		delta := r.delta(state, count)
+		if c.ResetCounters {
+			r.counts[state] = 0
+		}
+		if NegativeCounterReset == c.NegativeCounters && delta < 0 {
+			r.resets.Inc(1)
+			delta = count
+		}
+		value := count
+		if c.CounterDeltas {
+			value = delta
+		}
+		switch {
+		case NegativeCounterGaugeDelta == c.NegativeCounters:
+			s.gaugeDelta(key+".count", delta, rate)
+		case NegativeCounterDrop == c.NegativeCounters && value < 0:
+		case c.UseMeterType:
+			s.Mark(key+".count", value, rate)
+		default:
+			s.Increment(key+".count", int(value), rate)
+		}
+		if c.ReportCounterRate {
+			interval := r.elapsed
+			if 0 == interval {
+				interval = c.FlushInterval
+			}
+			s.GaugeFloat64(key+".rate", float64(delta)/interval.Seconds(), rate)
+		}
+	case Info:
+		r.reportInfo(c, s, key, metric.Labels(), rate)
+	case Gauge:
+		if c.SkipUnsetGauges {
+			if g, ok := metric.(gaugeSetter); ok && !g.IsSet() {
+				return
+			}
+		}
+		v := metric.Value()
+		r.gaugeRate(c, s, state, key, name, float64(v), rate)
+		if f := float64(v); r.clamp(c, &f) {
+			v = int64(f)
+		}
+		if c.smoothing() {
+			f := r.smooth(state, c.GaugeSmoothingAlpha, float64(v))
+			if r.outsideDeadband(c, state, f) {
+				s.GaugeFloat64(key+".value", f, rate)
+			}
+			return
+		}
+		if !r.outsideDeadband(c, state, float64(v)) {
+			return
+		}
+		s.GaugeInt64(key+".value", v, rate)
+	case GaugeFloat64:
+		v := metric.Value()
+		r.gaugeRate(c, s, state, key, name, v, rate)
+		r.clamp(c, &v)
+		if c.smoothing() {
+			v = r.smooth(state, c.GaugeSmoothingAlpha, v)
+		}
+		if !r.outsideDeadband(c, state, v) {
+			return
+		}
+		s.GaugeFloat64(key+".value", v, rate)
+	case Healthcheck:
+		err := metric.Error()
+		if nil == err {
+			s.GaugeInt64(key+".healthy", 1, rate)
+			return
+		}
+		if !c.HealthcheckErrorTags {
+			s.GaugeInt64(key+".healthy", 0, rate)
+			return
+		}
+		var tagged statsdClients
+		for _, client := range s {
+			if TagFormatNone == client.tagFormat {
+				client.GaugeInt64(key+".healthy", 0, rate)
+			} else {
+				tagged = append(tagged, client)
+			}
+		}
+		defer tagged.setTags(c, mergeTags(c.Tags, map[string]string{"error": err.Error()}))()
+		tagged.GaugeInt64(key+".healthy", 0, rate)
+	case Histogram:
+		if !c.ReportHistograms {
+			return
+		}
+		h := metric.Snapshot()
+		if !r.changed(c, state, [4]float64{
+			float64(h.Count()),
+			float64(h.Sum()),
+			float64(h.Min()),
+			float64(h.Max()),
+		}) {
+			return
+		}
+		percentiles := c.HistogramPercentiles
+		if nil == percentiles {
+			percentiles = c.Percentiles
+		}
+		if nil == percentiles {
+			percentiles = []float64{0.5, 0.75, 0.95, 0.99, 0.999}
+		}
+		var ps []float64
+		if PercentileNearestRank == c.PercentileMethod {
+			ps = SamplePercentilesNearestRank(h.Sample().Values(), percentiles)
+		} else {
+			ps = h.Percentiles(percentiles)
+		}
+		s.GaugeInt64(key+".count", h.Count(), rate)
+		s.GaugeInt64(key+".min", h.Min(), rate)
+		s.GaugeInt64(key+".max", h.Max(), rate)
+		s.GaugeFloat64(key+".mean", h.Mean(), rate)
+		s.GaugeFloat64(key+".std-dev", h.StdDev(), rate)
+		if c.ReportSum {
+			s.GaugeInt64(key+".sum", h.Sum(), rate)
+		}
+		if c.ReportVariance {
+			s.GaugeFloat64(key+".variance", h.Variance(), rate)
+		}
+		c.sendPercentiles(s, key, "", percentiles, ps, 1, rate)
+	case Meter:
+		m := metric.Snapshot()
+		if !r.changed(c, state, [4]float64{float64(m.Count())}) {
+			return
+		}
+		if MeterReportRates != c.MeterReportMode {
+			s.GaugeInt64(key+".count", m.Count(), rate)
+		}
+		if MeterReportCount != c.MeterReportMode {
+			s.GaugeFloat64(key+".one-minute", m.Rate1(), rate)
+			s.GaugeFloat64(key+".five-minute", m.Rate5(), rate)
+			s.GaugeFloat64(key+".fifteen-minute", m.Rate15(), rate)
+			s.GaugeFloat64(key+".mean", m.RateMean(), rate)
+		}
+	case Timer:
+		t := metric.Snapshot()
+		if !r.changed(c, state, [4]float64{
+			float64(t.Count()),
+			float64(t.Sum()),
+			float64(t.Min()),
+			float64(t.Max()),
+		}) {
+			return
+		}
+		unit := c.durationUnit(name)
+		du := float64(unit)
+		var suffix string
+		if c.DurationUnitSuffix {
+			suffix = "." + durationUnitName(unit)
+		}
+		percentiles := c.Percentiles
+		if nil == percentiles {
+			percentiles = []float64{0.5, 0.75, 0.95, 0.99, 0.999}
+		}
+		ps := c.percentiles(t, percentiles)
+		if c.TimerCountAsCounter {
+			s.Increment(key+".count", int(r.delta(state, t.Count())), rate)
+		} else {
+			s.GaugeInt64(key+".count", t.Count(), rate)
+		}
+		if c.UseTimingType {
+			s.Timing(key+".min"+suffix, t.Min()/int64(du), rate)
+			s.Timing(key+".max"+suffix, t.Max()/int64(du), rate)
+		} else {
+			s.GaugeInt64(key+".min"+suffix, t.Min()/int64(du), rate)
+			s.GaugeInt64(key+".max"+suffix, t.Max()/int64(du), rate)
+		}
+		s.GaugeFloat64(key+".mean"+suffix, t.Mean()/du, rate)
+		s.GaugeFloat64(key+".std-dev"+suffix, t.StdDev()/du, rate)
+		if c.ReportSum {
+			s.GaugeFloat64(key+".sum"+suffix, float64(t.Sum())/du, rate)
+		}
+		if c.ReportVariance {
+			s.GaugeFloat64(key+".variance"+suffix, t.Variance()/(du*du), rate)
+		}
+		c.sendPercentiles(s, key, suffix, percentiles, ps, du, rate)
+		if c.ReportTimerCountRate {
+			delta := r.delta(state+".count-rate", t.Count())
+			if 0 < r.elapsed {
+				s.GaugeFloat64(key+".count-rate", float64(delta)/r.elapsed.Seconds(), rate)
+			}
+		}
+		if c.ReportSampleSize {
+			s.GaugeInt64(key+".sample-size", sampleSize(t), rate)
+		}
+		if vt, ok := metric.(valueTaker); ok && c.TimerDistributions {
+			for _, v := range vt.TakeValues() {
+				s.Distribution(key+suffix, float64(v)/du, rate)
+			}
+		}
+		s.GaugeFloat64(key+".one-minute", t.Rate1(), rate)
+		s.GaugeFloat64(key+".five-minute", t.Rate5(), rate)
+		s.GaugeFloat64(key+".fifteen-minute", t.Rate15(), rate)
+		s.GaugeFloat64(key+".mean-rate", t.RateMean(), rate)
+	}
+}
+
+// reportTagged reports the metric registered under the given name, less any
+// tags TaggedName appended, with those tags added to c.Tags, overriding any
+// of the same name, or, to clients whose tag format doesn't support tags,
+// appended to its name as by labelName.  Its state is kept apart from that of
+// the same metric with other tags.
+func (r *StatsdReporter) reportTagged(c *StatsdConfig, ss statsdClients, scope, prefix, name string, tags map[string]string, i interface{}) {
+	if 0 == len(tags) {
+		r.report(c, ss, scope, prefix, name, i)
+		return
+	}
+	combo := TaggedName("", tags)
+	if 0 < c.MaxTagCardinality && !r.tagCombos[name][combo] {
+		if c.MaxTagCardinality <= len(r.tagCombos[name]) {
+			r.tagsDropped.Inc(1)
+			r.report(c, ss, scope+combo, prefix, name, i)
+			return
+		}
+		if nil == r.tagCombos[name] {
+			r.tagCombos[name] = make(map[string]bool)
+		}
+		r.tagCombos[name][combo] = true
+	}
+	var plain, tagged statsdClients
+	for _, s := range ss {
+		if TagFormatNone == s.tagFormat {
+			plain = append(plain, s)
+		} else {
+			tagged = append(tagged, s)
+		}
+	}
+	if 0 < len(plain) {
+		r.report(c, plain, scope, prefix, labelName(name, tags), i)
+	}
+	if 0 < len(tagged) {
+		defer tagged.setTags(c, mergeTags(c.Tags, tags))()
+		r.report(c, tagged, scope+combo, prefix, name, i)
+	}
+}
+
+// reportInfo sends an Info's constant value of 1 with its labels added to
+// c.Tags, overriding any of the same name, or, to clients whose tag format
+// doesn't support tags, appended to its name as by labelName.
+func (r *StatsdReporter) reportInfo(c *StatsdConfig, ss statsdClients, key string, labels map[string]string, rate float64) {
+	tags := mergeTags(c.Tags, labels)
+	for _, s := range ss {
+		if TagFormatNone == s.tagFormat {
+			s.GaugeInt64(labelName(key, labels)+".value", 1, rate)
+			continue
+		}
+		encoded, err := encodeTags(tags, s.tagFormat, c.SkipInvalid)
+		if nil != err {
+			c.onError(&StatsdError{StatsdErrorEncode, err})
+		}
+		if TagFormatGraphite == s.tagFormat {
+			s.sendTagged(key+".value", encoded, "", rate, "1|g")
+		} else {
+			s.sendTagged(key+".value", "", encoded, rate, "1|g")
+		}
+	}
+}
+
+// labelName returns name with the sorted keys and values of labels, dots
+// replaced with underscores, appended to it, for clients which can't send
+// them as tags.
+func labelName(name string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name += "." + strings.Replace(k, ".", "_", -1) + "." + strings.Replace(labels[k], ".", "_", -1)
+	}
+	return name
+}
+
+// mergeTags returns a new map of tags holding those of both maps, the
+// second's overriding the first's.
+func mergeTags(tags, overrides map[string]string) map[string]string {
+	merged := make(map[string]string, len(tags)+len(overrides))
+	for k, v := range tags {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	return merged
 }
 
-// Statsd is a blocking exporter function which reports metrics in r
-// to a statsd server located at addr, flushing them every d duration
-// and prepending metric names with prefix.
-func Statsd(r Registry, d time.Duration, prefix string, addr string) {
-	StatsdWithConfig(StatsdConfig{
-		Addr:          addr,
-		Registry:      r,
-		FlushInterval: d,
-		DurationUnit:  time.Nanosecond,
-		Prefix:        prefix,
-	})
+// clamp clamps the gauge value v into the range from c.GaugeMin to
+// c.GaugeMax, if that's not empty, counting and reporting whether it did so.
+func (r *StatsdReporter) clamp(c *StatsdConfig, v *float64) bool {
+	if c.GaugeMax <= c.GaugeMin {
+		return false
+	}
+	if *v < c.GaugeMin {
+		*v = c.GaugeMin
+	} else if c.GaugeMax < *v {
+		*v = c.GaugeMax
+	} else {
+		return false
+	}
+	r.clamped.Inc(1)
+	return true
 }
 
-// StatsdWithConfig is a blocking exporter function just like Statsd,
-// but it takes a StatsdConfig instead.
-func StatsdWithConfig(c StatsdConfig) {
-	for _ = range time.Tick(c.FlushInterval) {
-		if err := statsd(&c); nil != err {
-			log.Println(err)
+// reportCounter sends the count of a counter configured as c.plainCounters
+// reports, reusing the line sent for it by the previous flush, so that
+// counters whose counts haven't changed, as most don't, cost no formatting.
+func (r *StatsdReporter) reportCounter(c *StatsdConfig, s statsdClients, scope, prefix, name string, count int64) {
+	if r.counterFold != c.CaseFold {
+		r.counterFold = c.CaseFold
+		r.counterLines = make(map[statsdMetricID]*statsdCounterLine)
+	}
+	id := statsdMetricID{scope, prefix, name}
+	line, ok := r.counterLines[id]
+	if !ok {
+		key := c.foldCase(BuildMetricName(prefix, name, "", "."))
+		line = &statsdCounterLine{stat: key + ".count", state: scope + key}
+		r.counterLines[id] = line
+	}
+	if !ok || line.count != count {
+		line.count = count
+		line.format = strconv.FormatInt(count, 10) + "|c"
+	}
+	s.increment(line.stat, int(count), line.format)
+}
+
+// delta records the count of the named metric and returns its change since
+// the previous flush.  Statsd counters are summed by the server so sending
+// running totals counts every event once per flush, which is why
+// CounterDeltas sends these instead.
+func (r *StatsdReporter) delta(name string, count int64) int64 {
+	delta := count - r.counts[name]
+	r.counts[name] = count
+	return delta
+}
+
+// changed records the fingerprint of the named metric and reports whether it
+// should be sent, which it always should be unless c.ChangedOnly is set.
+func (r *StatsdReporter) changed(c *StatsdConfig, name string, fingerprint [4]float64) bool {
+	if !c.ChangedOnly {
+		return true
+	}
+	last, ok := r.fingerprints[name]
+	r.fingerprints[name] = fingerprint
+	return !ok || last != fingerprint
+}
+
+// outsideDeadband reports whether the named gauge's value v should be sent,
+// which it should be unless it's within c.GaugeDeadband of the value last
+// sent, and if so records v as the value last sent.
+func (r *StatsdReporter) outsideDeadband(c *StatsdConfig, name string, v float64) bool {
+	if c.GaugeDeadband <= 0 {
+		return true
+	}
+	last, ok := r.gauges[name]
+	if ok {
+		deadband := c.GaugeDeadband
+		if c.GaugeDeadbandPercent {
+			deadband *= math.Abs(last) / 100
+		}
+		if math.Abs(v-last) <= deadband {
+			return false
 		}
 	}
+	r.gauges[name] = v
+	return true
 }
 
-func statsd(c *StatsdConfig) error {
-	du := float64(c.DurationUnit)
+// smoothing reports whether gauges are to be smoothed.
+func (c *StatsdConfig) smoothing() bool {
+	return 0 < c.GaugeSmoothingAlpha && c.GaugeSmoothingAlpha < 1
+}
 
-	s, err := Dial(c.Addr)
-	if err != nil {
-		return err
+// gaugeRate sends the per-second change of the named gauge's value v since
+// the last flush if it's one of c.GaugeRateMetrics, and records v.
+func (r *StatsdReporter) gaugeRate(c *StatsdConfig, s statsdClients, state, key, name string, v, rate float64) {
+	for _, rateName := range c.GaugeRateMetrics {
+		if name != rateName {
+			continue
+		}
+		last, ok := r.gaugeRates[state]
+		r.gaugeRates[state] = v
+		if ok && 0 < r.elapsed {
+			s.GaugeFloat64(key+".rate", (v-last)/r.elapsed.Seconds(), rate)
+		}
+		return
 	}
+}
 
-	c.Registry.Each(func(name string, i interface{}) {
-		switch metric := i.(type) {
-		case Counter:
-			s.Increment(c.Prefix+"."+name+".count", int(metric.Count()), c.FlushInterval.Seconds())
-		case Gauge:
-			s.GaugeInt64(c.Prefix+"."+name+".value", metric.Value(), c.FlushInterval.Seconds())
-		case GaugeFloat64:
-			s.GaugeFloat64(c.Prefix+"."+name+".value", metric.Value(), c.FlushInterval.Seconds())
-		case Timer:
-			t := metric.Snapshot()
-			ps := t.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999})
-			s.GaugeInt64(c.Prefix+"."+name+".count", t.Count(), c.FlushInterval.Seconds())
-			s.GaugeInt64(c.Prefix+"."+name+".min", int64(du)*t.Min(), c.FlushInterval.Seconds())
-			s.GaugeInt64(c.Prefix+"."+name+".max", int64(du)*t.Max(), c.FlushInterval.Seconds())
-			s.GaugeFloat64(c.Prefix+"."+name+".mean", du*t.Mean(), c.FlushInterval.Seconds())
-			s.GaugeFloat64(c.Prefix+"."+name+".std-dev", du*t.StdDev(), c.FlushInterval.Seconds())
-			s.GaugeFloat64(c.Prefix+"."+name+".50-percentile", du*ps[0], c.FlushInterval.Seconds())
-			s.GaugeFloat64(c.Prefix+"."+name+".75-percentile", du*ps[1], c.FlushInterval.Seconds())
-			s.GaugeFloat64(c.Prefix+"."+name+".95-percentile", du*ps[2], c.FlushInterval.Seconds())
-			s.GaugeFloat64(c.Prefix+"."+name+".99-percentile", du*ps[3], c.FlushInterval.Seconds())
-			s.GaugeFloat64(c.Prefix+"."+name+".999-percentile", du*ps[4], c.FlushInterval.Seconds())
-			s.GaugeFloat64(c.Prefix+"."+name+".one-minute", t.Rate1(), c.FlushInterval.Seconds())
-			s.GaugeFloat64(c.Prefix+"."+name+".five-minute", t.Rate5(), c.FlushInterval.Seconds())
-			s.GaugeFloat64(c.Prefix+"."+name+".fifteen-minute", t.Rate15(), c.FlushInterval.Seconds())
-			s.GaugeFloat64(c.Prefix+"."+name+".mean-rate", t.RateMean(), c.FlushInterval.Seconds())
+// smooth folds the named gauge's value v into its moving average with the
+// given weight and returns the average.
+func (r *StatsdReporter) smooth(name string, alpha, v float64) float64 {
+	if last, ok := r.smoothed[name]; ok {
+		v = alpha*v + (1-alpha)*last
+	}
+	r.smoothed[name] = v
+	return v
+}
+
+// clock returns the Clock used to schedule and time flushes.
+func (c *StatsdConfig) clock() Clock {
+	if nil == c.Clock {
+		return SystemClock
+	}
+	return c.Clock
+}
+
+// onError passes err to c.OnError or, if that's nil, logs it.
+func (c *StatsdConfig) onError(err error) {
+	if nil == c.OnError {
+		log.Println(err)
+		return
+	}
+	c.OnError(err)
+}
+
+// recoverPanic, when deferred, recovers from a panic while doing something
+// to what's named and passes it to c.onError as an error.  The two are only
+// joined after a panic so that deferring it doesn't allocate.
+func (c *StatsdConfig) recoverPanic(doing, what string) {
+	if p := recover(); nil != p {
+		c.onError(&StatsdError{StatsdErrorFlush, fmt.Errorf("recovered from panic %s %s: %v", doing, what, p)})
+	}
+}
+
+// sampleRate returns the sample rate of the metric registered under the
+// given name, that of its entry in c.SampleRates or the longest entry that
+// prefixes it, or 1 if there's none.
+func (c *StatsdConfig) sampleRate(name string) float64 {
+	if rate, ok := c.SampleRates[name]; ok {
+		return rate
+	}
+	rate, longest := 1.0, -1
+	for prefix, r := range c.SampleRates {
+		if longest < len(prefix) && strings.HasPrefix(name, prefix) {
+			rate, longest = r, len(prefix)
 		}
-	})
+	}
+	return rate
+}
 
-	s.Close()
-	return nil
+// plainCounters reports whether counters are sent as their running totals
+// and nothing else, unsampled, which StatsdReporter.reportCounter sends
+// without going through the rest of report.
+func (c *StatsdConfig) plainCounters() bool {
+	return !c.CounterDeltas &&
+		!c.ResetCounters &&
+		!c.ChangedOnly &&
+		!c.UseMeterType &&
+		!c.ReportCounterRate &&
+		NegativeCounterSend == c.NegativeCounters &&
+		0 == len(c.SampleRates)
+}
+
+// foldCase returns the metric name folded according to c.CaseFold.
+func (c *StatsdConfig) foldCase(name string) string {
+	switch c.CaseFold {
+	case CaseFoldLower:
+		return strings.ToLower(name)
+	case CaseFoldUpper:
+		return strings.ToUpper(name)
+	}
+	return name
+}
+
+// durationUnit returns the time conversion unit for the timer registered
+// under the given name.
+func (c *StatsdConfig) durationUnit(name string) time.Duration {
+	if nil != c.DurationUnitFunc {
+		if unit := c.DurationUnitFunc(name); 0 != unit {
+			return unit
+		}
+	}
+	return c.DurationUnit
+}
+
+// durationUnitName returns the conventional abbreviation of the duration
+// unit d, such as "ms", or d formatted as by time.Duration.String if it has
+// none, with its decimal point, which would add a level to the metric's
+// path, replaced by "_" and any "µ" by "u", as in "1_5us".
+func durationUnitName(d time.Duration) string {
+	switch d {
+	case time.Nanosecond:
+		return "ns"
+	case time.Microsecond:
+		return "us"
+	case time.Millisecond:
+		return "ms"
+	case time.Second:
+		return "s"
+	case time.Minute:
+		return "m"
+	case time.Hour:
+		return "h"
+	}
+	return durationUnitReplacer.Replace(d.String())
+}
+
+// durationUnitReplacer replaces the decimal point and non-ASCII "µ" in the
+// names of nonstandard duration units.
+var durationUnitReplacer = strings.NewReplacer(".", "_", "µ", "u")
+
+// flushInterval returns c.FlushInterval raised to c.MinFlushInterval, if
+// it's shorter.
+func (c *StatsdConfig) flushInterval() time.Duration {
+	if c.FlushInterval < c.MinFlushInterval {
+		return c.MinFlushInterval
+	}
+	return c.FlushInterval
+}
+
+// newTicker returns a ticker from c's Clock every interval, first passing
+// an error to c.onError if that's c.FlushInterval raised to
+// c.MinFlushInterval.
+func (c *StatsdConfig) newTicker(interval time.Duration) Ticker {
+	if interval != c.FlushInterval {
+		c.onError(&StatsdError{StatsdErrorConfig, fmt.Errorf("flush interval %v raised to the minimum of %v", c.FlushInterval, c.MinFlushInterval)})
+	}
+	return c.clock().NewTicker(interval)
+}
+
+// dial connects to the statsd server and returns a new client configured
+// accordingly.
+func (c *StatsdConfig) dial() (*client, error) {
+	delimiter := byte('\n')
+	if 0 != c.MetricDelimiter {
+		delimiter = c.MetricDelimiter
+	}
+	var conn io.WriteCloser
+	switch c.Transport {
+	case "http", "https":
+		httpClient := c.HTTPClient
+		if nil == httpClient {
+			httpClient = &http.Client{Timeout: c.WriteTimeout}
+		}
+		conn = newHTTPConn(httpClient, c.Addr, delimiter)
+	default:
+		network := c.Transport
+		if "" == network {
+			network = "udp"
+		}
+		dial := c.Dialer
+		if nil == dial {
+			dial = net.Dial
+		}
+		netConn, err := dial(network, c.Addr)
+		if nil != err {
+			return nil, err
+		}
+		if 0 < c.WriteTimeout {
+			netConn.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+		}
+		if 0 < c.TCPKeepAlive {
+			if err := setKeepAlive(netConn, c.TCPKeepAlive); nil != err {
+				netConn.Close()
+				return nil, err
+			}
+		}
+		if 0 < c.SocketSendBufferBytes {
+			if err := setWriteBuffer(netConn, c.SocketSendBufferBytes); nil != err {
+				netConn.Close()
+				return nil, err
+			}
+		}
+		if c.ValidateOnDial && isStream(network) {
+			if err := validateConn(netConn, statsdValidateWait); nil != err {
+				netConn.Close()
+				return nil, err
+			}
+		}
+		conn = netConn
+		if c.RetryOnBufferFull {
+			conn = retryConn{netConn}
+		}
+	}
+	s := newClient(conn, c.PacketSize)
+	s.setDelimiter(delimiter)
+	s.stream = isStream(c.Transport)
+	if 0 != c.FloatFormat {
+		s.floatFormat = c.FloatFormat
+	}
+	s.flushEvery = c.FlushEveryNMetrics
+	return s, nil
+}
+
+// percentiles returns the given percentiles of the timer snapshot t computed
+// according to c.PercentileMethod.
+func (c *StatsdConfig) percentiles(t Timer, ps []float64) []float64 {
+	if PercentileNearestRank == c.PercentileMethod {
+		if ts, ok := t.(*TimerSnapshot); ok {
+			return SamplePercentilesNearestRank(ts.histogram.Sample().Values(), ps)
+		}
+	}
+	return t.Percentiles(ps)
+}
+
+// sendPercentiles sends the values ps of the given percentiles, divided by
+// unit and rounded if c.RoundPercentiles is set, skipping duplicates if
+// c.DedupPercentiles is set, under names ending in suffix.
+func (c *StatsdConfig) sendPercentiles(s statsdClients, key, suffix string, percentiles, ps []float64, unit, rate float64) {
+	if c.CompactPercentiles {
+		values := make([]float64, len(ps))
+		for psIdx, p := range ps {
+			values[psIdx] = p / unit
+			if c.RoundPercentiles {
+				values[psIdx] = math.Round(values[psIdx])
+			}
+		}
+		s.gaugeValues(key+".percentiles"+suffix, values, rate)
+		return
+	}
+	for psIdx, psKey := range percentiles {
+		if c.DedupPercentiles && 0 < psIdx && ps[psIdx] == ps[psIdx-1] {
+			continue
+		}
+		psName := strings.Replace(strconv.FormatFloat(psKey*100.0, 'f', -1, 64), ".", "", 1)
+		value := ps[psIdx] / unit
+		if c.RoundPercentiles {
+			value = math.Round(value)
+		}
+		s.GaugeFloat64(key+"."+psName+"-percentile"+suffix, value, rate)
+	}
+}
+
+// sampleSize returns the number of values in the sample behind the timer's
+// percentiles or, if it doesn't expose its sample, the number of events it's
+// timed.
+func sampleSize(t Timer) int64 {
+	if ts, ok := t.(*TimerSnapshot); ok {
+		return int64(ts.histogram.Sample().Size())
+	}
+	return t.Count()
+}
+
+// byteLimiter is a token bucket limiting the number of bytes sent per
+// second.
+type byteLimiter struct {
+	clock  Clock
+	last   time.Time
+	rate   float64
+	tokens float64
+}
+
+func newByteLimiter(clock Clock, bytesPerSecond int) *byteLimiter {
+	return &byteLimiter{
+		clock:  clock,
+		last:   clock.Now(),
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+	}
+}
+
+// allow reports whether n more bytes may be sent and, if so, spends them.
+func (l *byteLimiter) allow(n int) bool {
+	now := l.clock.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	if float64(n) > l.tokens {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// statsdSpill is a bounded ring buffer of the encoded metrics a client
+// couldn't send within its budget.
+type statsdSpill struct {
+	lines    []string
+	start, n int
+}
+
+// newStatsdSpill returns a new statsdSpill holding up to size metrics,
+// starting with the newest of those held by old, if it's not nil.
+func newStatsdSpill(size int, old *statsdSpill) *statsdSpill {
+	s := &statsdSpill{lines: make([]string, size)}
+	if nil != old {
+		for 0 < old.n {
+			s.push(old.pop())
+		}
+	}
+	return s
+}
+
+// push adds line as the newest metric, dropping the oldest if it's full and
+// reporting whether it did.
+func (s *statsdSpill) push(line string) bool {
+	dropped := len(s.lines) == s.n
+	if dropped {
+		s.pop()
+	}
+	s.lines[(s.start+s.n)%len(s.lines)] = line
+	s.n++
+	return dropped
+}
+
+// pop removes and returns the oldest metric.
+func (s *statsdSpill) pop() string {
+	line := s.lines[s.start]
+	s.lines[s.start] = ""
+	s.start = (s.start + 1) % len(s.lines)
+	s.n--
+	return line
 }
 
 // statsd client stuff
@@ -97,76 +2122,416 @@ type StatsClient interface {
 	Close() error
 }
 
+// TimingClient is a StatsClient which also records timings from
+// time.Durations, converted to statsd's milliseconds, as the clients
+// returned by Dial, DialTimeout and DialSize do unless middleware hides it.
+type TimingClient interface {
+	StatsClient
+	TimingDuration(stat string, d time.Duration, rate float64) error
+	TimeSince(stat string, start time.Time) error
+}
+
 // A statsd client representing a connection to a statsd server.
 type client struct {
-	conn net.Conn
+	conn io.WriteCloser
 	buf  *bufio.Writer
 	m    sync.Mutex
 
+	// The byte written between metrics sharing a packet, '\n' by default,
+	// and the strconv.FormatFloat format of float values, 'f' by default.
+	delimiter   byte
+	floatFormat byte
+
+	// The replacer sanitizing names, which replaces the delimiter.
+	replacer *strings.Replacer
+
+	// Whether the connection is a stream, on which packets are also
+	// terminated by the delimiter.
+	stream bool
+
+	// Metrics beyond the limiter's budget, if any, and all metrics once
+	// spilling is set are spilled to be sent next flush, if there's a spill,
+	// or else dropped and counted.  So are those in packets which
+	// backpressure keeps from being written.
+	dropped  Counter
+	limiter  *byteLimiter
+	spill    *statsdSpill
+	spilling bool
+
+	// Metrics skipped by sampling are counted.
+	sampledOut Counter
+
+	// The target dialed, if by a StatsdReporter, and the encoded tags to be
+	// added to every metric, either after its value or, for
+	// TagFormatGraphite, after its name, with any error encoding them.
+	target    StatsdTarget
+	tagFormat TagFormat
+	tags      string
+	nameTags  string
+	tagErr    error
+
+	// The names sent so far, if collisions are to be detected, and the
+	// first collision refused under CollisionError.
+	collisionErr error
+	collisions   CollisionPolicy
+	names        map[string]bool
+
+	// The metrics held back until Close, if they're to be coalesced, and
+	// their indices by name and type.
+	coalesced map[string]int
+	pending   []coalescedMetric
+
+	// The number of metrics buffered and the number after which they're
+	// flushed regardless of their size, if nonzero.
+	buffered   int
+	flushEvery int
+
+	// The most bytes buffered at once and the total bytes buffered.
+	highWater int
+	sent      int64
+
 	// The prefix to be added to every key. Should include the "." at the end if desired
 	prefix string
 }
 
-// Dial connects to the given address on the given network using net.Dial and then returns a new client for the connection.
-func Dial(addr string) (StatsClient, error) {
+// Dial connects to the given address on the given network using net.Dial and then returns a new client for the connection,
+// wrapped by any middleware as by WrapClient.
+func Dial(addr string, middleware ...ClientMiddleware) (StatsClient, error) {
 	conn, err := net.Dial("udp", addr)
 	if err != nil {
 		return nil, err
 	}
-	return newClient(conn, 0), nil
+	return WrapClient(newClient(conn, 0), middleware...), nil
 }
 
 // DialTimeout acts like Dial but takes a timeout. The timeout includes name resolution, if required.
-func DialTimeout(addr string, timeout time.Duration) (StatsClient, error) {
+func DialTimeout(addr string, timeout time.Duration, middleware ...ClientMiddleware) (StatsClient, error) {
 	conn, err := net.DialTimeout("udp", addr, timeout)
 	if err != nil {
 		return nil, err
 	}
-	return newClient(conn, 0), nil
+	return WrapClient(newClient(conn, 0), middleware...), nil
 }
 
 // DialSize acts like Dial but takes a packet size.
 // By default, the packet size is 512, see https://github.com/etsy/statsd/blob/master/docs/metric_types.md#multi-metric-packets for guidelines.
-func DialSize(addr string, size int) (StatsClient, error) {
+func DialSize(addr string, size int, middleware ...ClientMiddleware) (StatsClient, error) {
 	conn, err := net.Dial("udp", addr)
 	if err != nil {
 		return nil, err
 	}
-	return newClient(conn, size), nil
+	return WrapClient(newClient(conn, size), middleware...), nil
 }
 
-func newClient(conn net.Conn, size int) *client {
+func newClient(conn io.WriteCloser, size int) *client {
 	if size <= 0 {
 		size = defaultBufSize
 	}
-	return &client{
-		conn: conn,
-		buf:  bufio.NewWriterSize(conn, size),
+	c := &client{
+		conn:        conn,
+		delimiter:   '\n',
+		dropped:     NilCounter{},
+		floatFormat: 'f',
+		replacer:    statsdNameReplacer,
+		sampledOut:  NilCounter{},
+	}
+	c.buf = bufio.NewWriterSize(packetWriter{c}, size)
+	return c
+}
+
+// statsdNameReplacer replaces the characters which would end a metric's name
+// early or split it in two when metrics are delimited by newlines.
+var statsdNameReplacer = newStatsdNameReplacer('\n')
+
+// newStatsdNameReplacer returns a replacer for the characters which would end
+// a metric's name early or split it in two when metrics are delimited by the
+// given delimiter.
+func newStatsdNameReplacer(delimiter byte) *strings.Replacer {
+	oldnew := []string{":", "_", "|", "_", "\n", "_"}
+	if ':' != delimiter && '|' != delimiter && '\n' != delimiter {
+		oldnew = append(oldnew, string(delimiter), "_")
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+// packetWriter writes each packet flushed by a client's buffer to its
+// connection, trimming any trailing delimiters, which some strict servers
+// reject, unless the connection's a stream, on which packets are framed by
+// exactly one, and skipping packets left empty.
+type packetWriter struct {
+	c *client
+}
+
+func (w packetWriter) Write(b []byte) (int, error) {
+	packet := b
+	for 0 < len(packet) && w.c.delimiter == packet[len(packet)-1] {
+		packet = packet[:len(packet)-1]
+	}
+	if 0 == len(packet) {
+		return len(b), nil
+	}
+	lines := packet
+	if w.c.stream {
+		packet = append(packet[:len(packet):len(packet)], w.c.delimiter)
+	}
+	if n, err := w.c.conn.Write(packet); nil != err {
+		if 0 != n || nil == w.c.spill || !isBackpressure(err) {
+			return 0, err
+		}
+		for _, line := range strings.Split(string(lines), string(w.c.delimiter)) {
+			if w.c.spill.push(line) {
+				w.c.dropped.Inc(1)
+			}
+		}
+	}
+	return len(b), nil
+}
+
+// coalescedMetric is a counter or gauge held back by a client until Close.
+type coalescedMetric struct {
+	stat     string
+	nameTags string
+	tags     string
+	rate     float64
+	count    int    // The sum of a counter's increments.
+	value    string // The last formatted value of a gauge, empty for counters.
+}
+
+// statsdClients sends every metric to each of several clients.
+type statsdClients []*client
+
+// increment is like Increment but takes the count already formatted, as in
+// "1|c", and sends it unsampled.
+func (ss statsdClients) increment(stat string, count int, format string) {
+	for _, s := range ss {
+		if !s.coalesce(stat, 1, count, "") {
+			s.send(stat, 1, format)
+		}
+	}
+}
+
+// Increment the counter for the given bucket on every client.
+func (ss statsdClients) Increment(stat string, count int, rate float64) {
+	for _, s := range ss {
+		s.Increment(stat, count, rate)
+	}
+}
+
+// GaugeFloat64 records the value for the given bucket on every client.
+func (ss statsdClients) GaugeFloat64(stat string, value, rate float64) {
+	for _, s := range ss {
+		s.GaugeFloat64(stat, value, rate)
+	}
+}
+
+// GaugeInt64 records the value for the given bucket on every client.
+func (ss statsdClients) GaugeInt64(stat string, value int64, rate float64) {
+	for _, s := range ss {
+		s.GaugeInt64(stat, value, rate)
+	}
+}
+
+// Timing records the timing for the given bucket on every client.
+func (ss statsdClients) Timing(stat string, value int64, rate float64) {
+	for _, s := range ss {
+		s.Timing(stat, value, rate)
+	}
+}
+
+// gaugeValues records several values for the given bucket in one line on
+// every client.
+func (ss statsdClients) gaugeValues(stat string, values []float64, rate float64) {
+	for _, s := range ss {
+		s.gaugeValues(stat, values, rate)
+	}
+}
+
+// Mark records events in the given bucket's meter on every client.
+func (ss statsdClients) Mark(stat string, count int64, rate float64) {
+	for _, s := range ss {
+		s.Mark(stat, count, rate)
+	}
+}
+
+// Distribution records the value in the given bucket's distribution on
+// every client using TagFormatDatadog, the only dialect supporting them.
+func (ss statsdClients) Distribution(stat string, value, rate float64) {
+	for _, s := range ss {
+		if TagFormatDatadog == s.tagFormat {
+			s.Distribution(stat, value, rate)
+		}
+	}
+}
+
+// spillRest makes every client spill the metrics sent from now on rather
+// than send them.
+func (ss statsdClients) spillRest() {
+	for _, s := range ss {
+		s.m.Lock()
+		s.spilling = true
+		s.m.Unlock()
+	}
+}
+
+// setTags replaces the encoded tags every client adds to metrics with the
+// given tags and returns a function restoring them.
+func (ss statsdClients) setTags(c *StatsdConfig, tags map[string]string) func() {
+	saved := make([][2]string, len(ss))
+	for i, s := range ss {
+		saved[i] = [2]string{s.nameTags, s.tags}
+		encoded, err := encodeTags(tags, s.tagFormat, c.SkipInvalid)
+		if nil != err {
+			c.onError(&StatsdError{StatsdErrorEncode, err})
+		}
+		if TagFormatGraphite == s.tagFormat {
+			s.nameTags = encoded
+		} else {
+			s.tags = encoded
+		}
+	}
+	return func() {
+		for i, s := range ss {
+			s.nameTags, s.tags = saved[i][0], saved[i][1]
+		}
+	}
+}
+
+// gaugeDelta adjusts the gauge for the given bucket on every client.
+func (ss statsdClients) gaugeDelta(stat string, delta int64, rate float64) {
+	for _, s := range ss {
+		s.gaugeDelta(stat, delta, rate)
 	}
 }
 
 // Increment the counter for the given bucket.
 func (c *client) Increment(stat string, count int, rate float64) error {
+	if c.coalesce(stat, rate, count, "") {
+		return nil
+	}
 	return c.send(stat, rate, strconv.Itoa(count)+"|c")
 }
 
 // Record arbitrary values for the given bucket. float64
 func (c *client) GaugeFloat64(stat string, value, rate float64) error {
-	return c.send(stat, rate, strconv.FormatFloat(value, 'f', -1, 64)+"|g")
+	formatted := strconv.FormatFloat(value, c.floatFormat, -1, 64)
+	if c.coalesce(stat, rate, 0, formatted) {
+		return nil
+	}
+	return c.send(stat, rate, formatted+"|g")
 }
 
 // Record arbitrary values for the given bucket. int64
 func (c *client) GaugeInt64(stat string, value int64, rate float64) error {
-	return c.send(stat, rate, strconv.FormatInt(value, 10)+"|g")
+	formatted := strconv.FormatInt(value, 10)
+	if c.coalesce(stat, rate, 0, formatted) {
+		return nil
+	}
+	return c.send(stat, rate, formatted+"|g")
+}
+
+// Timing records a timing, in milliseconds, for the given bucket.
+func (c *client) Timing(stat string, value int64, rate float64) error {
+	return c.send(stat, rate, strconv.FormatInt(value, 10)+"|ms")
+}
+
+// TimingDuration records the duration d as a timing, in fractional
+// milliseconds, for the given bucket.
+func (c *client) TimingDuration(stat string, d time.Duration, rate float64) error {
+	ms := float64(d) / float64(time.Millisecond)
+	return c.send(stat, rate, strconv.FormatFloat(ms, c.floatFormat, -1, 64)+"|ms")
+}
+
+// TimeSince records the time elapsed since start as a timing for the given
+// bucket.
+func (c *client) TimeSince(stat string, start time.Time) error {
+	return c.TimingDuration(stat, time.Since(start), 1)
+}
+
+// gaugeValues records several values for the given bucket in one line, in
+// the non-standard "stat:value:value|g" form.
+func (c *client) gaugeValues(stat string, values []float64, rate float64) error {
+	formatted := make([]string, len(values))
+	for i, value := range values {
+		formatted[i] = strconv.FormatFloat(value, c.floatFormat, -1, 64)
+	}
+	return c.send(stat, rate, strings.Join(formatted, ":")+"|g")
+}
+
+// Mark records count events in the given bucket's meter.
+func (c *client) Mark(stat string, count int64, rate float64) error {
+	return c.send(stat, rate, strconv.FormatInt(count, 10)+"|m")
+}
+
+// Distribution records a value in the given bucket's DogStatsD distribution,
+// which Datadog aggregates across hosts.
+func (c *client) Distribution(stat string, value, rate float64) error {
+	return c.send(stat, rate, strconv.FormatFloat(value, c.floatFormat, -1, 64)+"|d")
+}
+
+// gaugeDelta adjusts the gauge for the given bucket by delta, which is always
+// sent with its sign so that it isn't taken for a new value.
+func (c *client) gaugeDelta(stat string, delta int64, rate float64) error {
+	formatted := strconv.FormatInt(delta, 10)
+	if 0 <= delta {
+		formatted = "+" + formatted
+	}
+	return c.send(stat, rate, formatted+"|g")
+}
+
+// coalesce holds a counter increment or, if value isn't empty, a gauge
+// value back until Close, merging it with any held under the same name, and
+// returns whether it did so.
+func (c *client) coalesce(stat string, rate float64, count int, value string) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if nil == c.coalesced {
+		return false
+	}
+	key := stat + c.nameTags + c.tags + "|c"
+	if "" != value {
+		key = stat + c.nameTags + c.tags + "|g"
+	}
+	idx, ok := c.coalesced[key]
+	if !ok {
+		idx = len(c.pending)
+		c.coalesced[key] = idx
+		c.pending = append(c.pending, coalescedMetric{stat: stat, nameTags: c.nameTags, tags: c.tags})
+	}
+	c.pending[idx].rate = rate
+	c.pending[idx].count += count
+	c.pending[idx].value = value
+	return true
+}
+
+// setDelimiter sets the byte written between metrics, which is replaced in
+// their names and tags.
+func (c *client) setDelimiter(delimiter byte) {
+	c.delimiter = delimiter
+	c.replacer = statsdNameReplacer
+	if '\n' != delimiter {
+		c.replacer = newStatsdNameReplacer(delimiter)
+	}
 }
 
 // Flush writes any buffered data to the network.
 func (c *client) Flush() error {
+	c.buffered = 0
 	return c.buf.Flush()
 }
 
 // Closes the connection.
 func (c *client) Close() error {
+	c.m.Lock()
+	pending := c.pending
+	c.coalesced, c.pending = nil, nil
+	c.m.Unlock()
+	for _, metric := range pending {
+		if "" == metric.value {
+			c.sendTagged(metric.stat, metric.nameTags, metric.tags, metric.rate, strconv.Itoa(metric.count)+"|c")
+		} else {
+			c.sendTagged(metric.stat, metric.nameTags, metric.tags, metric.rate, metric.value+"|g")
+		}
+	}
 	if err := c.Flush(); err != nil {
 		return err
 	}
@@ -175,31 +2540,134 @@ func (c *client) Close() error {
 }
 
 func (c *client) send(stat string, rate float64, format string, args ...interface{}) error {
+	return c.sendTagged(stat, c.nameTags, c.tags, rate, format, args...)
+}
+
+// sendTagged is like send but adds the given encoded tags in place of the
+// client's own.
+func (c *client) sendTagged(stat, nameTags, tags string, rate float64, format string, args ...interface{}) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	stat = c.replacer.Replace(stat)
+
+	// Tags are sanitized of all but a custom delimiter when they're
+	// encoded, so that's replaced here, as it is in names.
+	if '\n' != c.delimiter {
+		delimiter := string(c.delimiter)
+		nameTags = strings.Replace(nameTags, delimiter, "_", -1)
+		tags = strings.Replace(tags, delimiter, "_", -1)
+	}
+
+	if nil != c.names {
+		if c.names[stat+nameTags+tags] {
+			switch c.collisions {
+			case CollisionLog:
+				log.Printf("statsd metric name collision: %s", stat)
+			case CollisionError:
+				err := MetricNameCollision(stat)
+				if nil == c.collisionErr {
+					c.collisionErr = err
+				}
+				return err
+			}
+		}
+		c.names[stat+nameTags+tags] = true
+	}
+
 	if rate < 1 {
 		if rand.Float64() < rate {
 			format = format + "|@" + strconv.FormatFloat(rate, 'f', -1, 64)
 		} else {
+			c.sampledOut.Inc(1)
 			return nil
 		}
 	}
 
-	format = c.prefix + stat + ":" + format
+	// Values are formatted with args, if there are any, but names are
+	// always written verbatim so that relayed names may contain '%'.
+	if 0 < len(args) {
+		format = fmt.Sprintf(format, args...)
+	}
+
+	// The metric is written to the buffer piece by piece rather than
+	// concatenated first, which would allocate for every metric sent.
+	pieces := [...]string{c.prefix, stat, nameTags, ":", format, tags}
+	return c.buffer(pieces[:])
+}
 
+// drainSpill sends the metrics spilled by earlier flushes, oldest first, so
+// long as they fit within the budget, leaving the rest spilled.
+func (c *client) drainSpill() {
 	c.m.Lock()
 	defer c.m.Unlock()
+	for n := c.spill.n; 0 < n; n-- {
+		c.buffer([]string{c.spill.pop()})
+	}
+}
+
+// buffer buffers the metric made of the given pieces, flushing those already
+// buffered first if it doesn't fit with them.  The caller must hold c.m.
+func (c *client) buffer(pieces []string) error {
+	size := 0
+	for _, piece := range pieces {
+		size += len(piece)
+	}
 
-	// Flush data if we have reach the buffer limit
-	if c.buf.Available() < len(format) {
+	// Flush data if we have reach the buffer limit, counting the delimiter
+	// that would separate this metric from those already buffered
+	if c.buf.Buffered() > 0 && c.buf.Available() < size+1 {
 		if err := c.Flush(); err != nil {
-			return nil
+			return err
 		}
 	}
 
 	// Buffer is not empty, start filling it
-	if c.buf.Buffered() > 0 {
-		format = "\n" + format
+	delimited := c.buf.Buffered() > 0
+	if delimited {
+		size++
 	}
 
-	_, err := fmt.Fprintf(c.buf, format, args...)
-	return err
+	if c.spilling || nil != c.limiter && !c.limiter.allow(size) {
+		if nil == c.spill || c.spill.push(strings.Join(pieces, "")) {
+			c.dropped.Inc(1)
+		}
+		return nil
+	}
+
+	// A metric too big for a packet of its own is written to the connection
+	// whole rather than split between packets by the buffer.
+	if !delimited && c.buf.Available() < size {
+		n, err := packetWriter{c}.Write([]byte(strings.Join(pieces, "")))
+		c.sent += int64(n)
+		return err
+	}
+
+	var (
+		n   int
+		err error
+	)
+	if delimited {
+		if err = c.buf.WriteByte(c.delimiter); nil == err {
+			n++
+		}
+	}
+	for _, piece := range pieces {
+		m, pieceErr := c.buf.WriteString(piece)
+		n += m
+		if nil == err {
+			err = pieceErr
+		}
+	}
+	c.sent += int64(n)
+	if c.highWater < c.buf.Buffered() {
+		c.highWater = c.buf.Buffered()
+	}
+	if nil != err {
+		return err
+	}
+	if c.buffered++; 0 < c.flushEvery && c.flushEvery <= c.buffered {
+		return c.Flush()
+	}
+	return nil
 }
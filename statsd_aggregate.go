@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// aggregatingClient sums increments in memory and sends each bucket's sum
+// through another StatsClient once per window, so hot counters incremented
+// directly send one metric per window rather than one per call.
+type aggregatingClient struct {
+	client StatsClient
+	closed bool
+	counts map[string]int
+	done   chan struct{}
+	mutex  sync.Mutex
+	stop   chan struct{}
+
+	// Calls to the client are serialized as flushing it isn't safe
+	// alongside sending through it.
+	sending sync.Mutex
+}
+
+// NewAggregatingClient returns a StatsClient which sums increments to each
+// bucket and sends the sums through c every window.  Every increment is
+// summed, whatever its sample rate, so the sums are exact and sent
+// unsampled.  Gauges are sent through c at once.  Close sends the sums so
+// far before closing c.
+func NewAggregatingClient(c StatsClient, window time.Duration) StatsClient {
+	return NewAggregatingClientWithClock(c, window, SystemClock)
+}
+
+// NewAggregatingClientWithClock is like NewAggregatingClient but times the
+// window with the given Clock, as exporters' configs' Clocks time their
+// flushes.
+func NewAggregatingClientWithClock(c StatsClient, window time.Duration, clock Clock) StatsClient {
+	a := &aggregatingClient{
+		client: c,
+		counts: make(map[string]int),
+		done:   make(chan struct{}),
+		stop:   make(chan struct{}),
+	}
+	go a.run(clock.NewTicker(window))
+	return a
+}
+
+// Increment adds count to the sum for the given bucket.  The sample rate is
+// ignored, as sampling a sum would only lose precision.
+func (a *aggregatingClient) Increment(stat string, count int, rate float64) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.closed {
+		return ErrStatsClientClosed
+	}
+	a.counts[stat] += count
+	return nil
+}
+
+// GaugeFloat64 sends a float64 value for the given bucket.
+func (a *aggregatingClient) GaugeFloat64(stat string, value, rate float64) error {
+	a.sending.Lock()
+	defer a.sending.Unlock()
+	return a.client.GaugeFloat64(stat, value, rate)
+}
+
+// GaugeInt64 sends an int64 value for the given bucket.
+func (a *aggregatingClient) GaugeInt64(stat string, value int64, rate float64) error {
+	a.sending.Lock()
+	defer a.sending.Unlock()
+	return a.client.GaugeInt64(stat, value, rate)
+}
+
+// Close sends the sums so far and then closes the underlying client.
+func (a *aggregatingClient) Close() error {
+	a.mutex.Lock()
+	if a.closed {
+		a.mutex.Unlock()
+		return ErrStatsClientClosed
+	}
+	a.closed = true
+	a.mutex.Unlock()
+	close(a.stop)
+	<-a.done
+	err := a.flush()
+	if closeErr := a.client.Close(); nil == err {
+		err = closeErr
+	}
+	return err
+}
+
+// statsFlusher is implemented by StatsClients, such as those returned by
+// Dial, which buffer metrics until they're flushed.
+type statsFlusher interface {
+	Flush() error
+}
+
+// flush sends and resets the sums, flushing the underlying client if it
+// buffers them, and returns the first error sending them.
+func (a *aggregatingClient) flush() (err error) {
+	a.mutex.Lock()
+	counts := a.counts
+	a.counts = make(map[string]int, len(counts))
+	a.mutex.Unlock()
+	a.sending.Lock()
+	defer a.sending.Unlock()
+	for stat, count := range counts {
+		if sendErr := a.client.Increment(stat, count, 1); nil == err {
+			err = sendErr
+		}
+	}
+	if f, ok := a.client.(statsFlusher); ok && 0 < len(counts) {
+		if flushErr := f.Flush(); nil == err {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+func (a *aggregatingClient) run(ticker Ticker) {
+	defer close(a.done)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			a.flush()
+		case <-a.stop:
+			return
+		}
+	}
+}
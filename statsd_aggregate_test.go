@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAggregatingClient(t *testing.T) {
+	conn := &statsdTestConn{}
+	a := NewAggregatingClient(newClient(conn, 0), time.Hour)
+	for i := 0; i < 1000; i++ {
+		if err := a.Increment("x", 1, 1); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if err := a.GaugeInt64("y", 47, 1); nil != err {
+		t.Fatal(err)
+	}
+	if err := a.Close(); nil != err {
+		t.Fatal(err)
+	}
+	if lines := statsdLines(conn.Packets()); 2 != len(lines) || !lines["x:1000|c"] || !lines["y:47|g"] {
+		t.Fatal(lines)
+	}
+	if err := a.Increment("x", 1, 1); ErrStatsClientClosed != err {
+		t.Fatal(err)
+	}
+}
+
+func TestAggregatingClientWindow(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	c, err := Dial(server.Addr())
+	if nil != err {
+		t.Fatal(err)
+	}
+	a := NewAggregatingClient(c, 10*time.Millisecond)
+	defer a.Close()
+	for i := 0; i < 1000; i++ {
+		a.Increment("x", 1, 1)
+	}
+	if packets := server.Packets(); 1 != len(packets) || "x:1000|c" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+}
+
+// flushSignalClient is a client which signals every flush.
+type flushSignalClient struct {
+	*client
+	flushed chan struct{}
+}
+
+func (c flushSignalClient) Flush() error {
+	err := c.client.Flush()
+	c.flushed <- struct{}{}
+	return err
+}
+
+func TestAggregatingClientClock(t *testing.T) {
+	conn := &statsdTestConn{}
+	clock := newFakeClock()
+	c := flushSignalClient{newClient(conn, 0), make(chan struct{}, 1)}
+	a := NewAggregatingClientWithClock(c, time.Minute, clock)
+	defer a.Close()
+	for i := 0; i < 1000; i++ {
+		a.Increment("x", 1, 1)
+	}
+	clock.Advance(time.Minute - 1)
+	if packets := conn.Packets(); 0 != len(packets) {
+		t.Fatalf("%q", packets)
+	}
+	clock.Advance(1)
+	<-c.flushed
+	if packets := conn.Packets(); 1 != len(packets) || "x:1000|c" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestAggregatingClientSampleRate(t *testing.T) {
+	conn := &statsdTestConn{}
+	a := NewAggregatingClient(newClient(conn, 0), time.Hour)
+	for i := 0; i < 1000; i++ {
+		a.Increment("x", 1, 0.1)
+	}
+	a.Increment("x", 1, 1)
+	if err := a.Close(); nil != err {
+		t.Fatal(err)
+	}
+	if lines := statsdLines(conn.Packets()); 1 != len(lines) || !lines["x:1001|c"] {
+		t.Fatal(lines)
+	}
+}
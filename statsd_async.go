@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrStatsClientClosed is returned when sending through a closed client.
+var ErrStatsClientClosed = errors.New("statsd client closed")
+
+// ErrStatsQueueFull is returned when an async client's queue has no room.
+var ErrStatsQueueFull = errors.New("statsd queue full")
+
+// ErrStatsDrainTimeout is returned by Close when an async client's queue
+// isn't drained within its drain timeout.
+var ErrStatsDrainTimeout = errors.New("statsd queue not drained before timeout")
+
+// asyncClient queues metrics to be sent through another StatsClient by a
+// background goroutine so that callers never wait on the network.
+type asyncClient struct {
+	abort    chan struct{}
+	client   StatsClient
+	clock    Clock
+	closeErr error
+	closed   bool
+	done     chan struct{}
+	mutex    sync.RWMutex
+	queue    chan func(StatsClient) error
+	timeout  time.Duration
+}
+
+// NewAsyncClient returns a StatsClient which queues up to size metrics for
+// a background goroutine to send through c.  Metrics which don't fit in the
+// queue are dropped and ErrStatsQueueFull returned.  Close sends everything
+// still queued before closing c.  If that takes longer than drainTimeout it
+// returns ErrStatsDrainTimeout at once, without waiting on a metric being
+// sent, and c is closed once that's been sent.
+func NewAsyncClient(c StatsClient, size int, drainTimeout time.Duration) StatsClient {
+	a := &asyncClient{
+		abort:   make(chan struct{}),
+		client:  c,
+		clock:   SystemClock,
+		done:    make(chan struct{}),
+		queue:   make(chan func(StatsClient) error, size),
+		timeout: drainTimeout,
+	}
+	go a.run()
+	return a
+}
+
+// Increment queues an increment of the counter for the given bucket.
+func (a *asyncClient) Increment(stat string, count int, rate float64) error {
+	return a.enqueue(func(c StatsClient) error { return c.Increment(stat, count, rate) })
+}
+
+// GaugeFloat64 queues a float64 value for the given bucket.
+func (a *asyncClient) GaugeFloat64(stat string, value, rate float64) error {
+	return a.enqueue(func(c StatsClient) error { return c.GaugeFloat64(stat, value, rate) })
+}
+
+// GaugeInt64 queues an int64 value for the given bucket.
+func (a *asyncClient) GaugeInt64(stat string, value int64, rate float64) error {
+	return a.enqueue(func(c StatsClient) error { return c.GaugeInt64(stat, value, rate) })
+}
+
+// Close drains the queue and then closes the underlying client, returning
+// ErrStatsDrainTimeout if that takes longer than the drain timeout.
+func (a *asyncClient) Close() error {
+	a.mutex.Lock()
+	if a.closed {
+		a.mutex.Unlock()
+		return ErrStatsClientClosed
+	}
+	a.closed = true
+	close(a.queue)
+	a.mutex.Unlock()
+
+	if 0 < a.timeout {
+		ticker := a.clock.NewTicker(a.timeout)
+		defer ticker.Stop()
+		select {
+		case <-a.done:
+			return a.closeErr
+		case <-ticker.C():
+		}
+	}
+	select {
+	case <-a.done:
+		return a.closeErr
+	default:
+	}
+	close(a.abort)
+	return ErrStatsDrainTimeout
+}
+
+func (a *asyncClient) enqueue(f func(StatsClient) error) error {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if a.closed {
+		return ErrStatsClientClosed
+	}
+	select {
+	case a.queue <- f:
+		return nil
+	default:
+		return ErrStatsQueueFull
+	}
+}
+
+// run sends the queued metrics until the queue is closed and drained or
+// Close gives up on it, and then closes the underlying client.  The queue is
+// always closed before Close gives up, so ranging over it never blocks then.
+func (a *asyncClient) run() {
+	defer close(a.done)
+	for f := range a.queue {
+		select {
+		case <-a.abort:
+			a.client.Close()
+			return
+		default:
+		}
+		f(a.client)
+	}
+	a.closeErr = a.client.Close()
+}
@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// blockingStatsClient is a StatsClient whose increments block until
+// released, as sends on a stalled stream connection may.
+type blockingStatsClient struct {
+	closed  chan struct{}
+	release chan struct{}
+	sending chan struct{}
+	sent    chan struct{}
+}
+
+func newBlockingStatsClient() *blockingStatsClient {
+	return &blockingStatsClient{
+		closed:  make(chan struct{}),
+		release: make(chan struct{}),
+		sending: make(chan struct{}, 100),
+		sent:    make(chan struct{}, 100),
+	}
+}
+
+func (c *blockingStatsClient) Increment(string, int, float64) error {
+	c.sending <- struct{}{}
+	<-c.release
+	c.sent <- struct{}{}
+	return nil
+}
+
+func (c *blockingStatsClient) GaugeFloat64(string, float64, float64) error { return nil }
+
+func (c *blockingStatsClient) GaugeInt64(string, int64, float64) error { return nil }
+
+func (c *blockingStatsClient) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestAsyncClientDrainsOnClose(t *testing.T) {
+	conn := &statsdTestConn{}
+	a := NewAsyncClient(newClient(conn, 0), 100, time.Second)
+	for i := 0; i < 50; i++ {
+		if err := a.Increment(fmt.Sprintf("foo%d", i), 1, 1); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Close(); nil != err {
+		t.Fatal(err)
+	}
+	lines := statsdLines(conn.Packets())
+	for i := 0; i < 50; i++ {
+		if line := fmt.Sprintf("foo%d:1|c", i); !lines[line] {
+			t.Errorf("%s missing", line)
+		}
+	}
+	if err := a.Increment("foo", 1, 1); ErrStatsClientClosed != err {
+		t.Error(err)
+	}
+}
+
+func TestAsyncClientDrainTimeout(t *testing.T) {
+	c, clock := newBlockingStatsClient(), newFakeClock()
+	a := NewAsyncClient(c, 10, time.Second).(*asyncClient)
+	a.clock = clock
+	for i := 0; i < 10; i++ {
+		a.Increment("foo", 1, 1)
+	}
+	<-c.sending
+	errs := make(chan error)
+	go func() { errs <- a.Close() }()
+	<-clock.created
+	clock.Advance(time.Second)
+	if err := <-errs; ErrStatsDrainTimeout != err {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.closed:
+		t.Fatal("closed while a metric was being sent")
+	default:
+	}
+	close(c.release)
+	<-c.closed
+	if sent := len(c.sent); 10 <= sent {
+		t.Errorf("sent all %d metrics", sent)
+	}
+}
+
+func TestAsyncClientQueueFull(t *testing.T) {
+	c := newBlockingStatsClient()
+	defer close(c.release)
+	a := NewAsyncClient(c, 1, 0)
+	defer a.Close()
+	var err error
+	for i := 0; i < 3 && nil == err; i++ {
+		err = a.Increment("foo", 1, 1)
+	}
+	if ErrStatsQueueFull != err {
+		t.Fatal(err)
+	}
+}
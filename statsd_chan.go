@@ -0,0 +1,27 @@
+package metrics
+
+// chanConn sends each packet written by a statsd client on a channel.
+type chanConn chan<- []byte
+
+// NewChannelClient returns a StatsClient which, instead of writing to a
+// socket, sends each formatted packet on ch so the statsd exporter can be
+// used purely as a formatter for another dispatch system.  Packets hold as
+// many newline-delimited metrics as fit in the default buffer size and are
+// copies the receiver may keep.  Sends block, so a slow receiver stalls the
+// client and, through it, the flush.  Close doesn't close ch.
+func NewChannelClient(ch chan<- []byte) StatsClient {
+	return newClient(chanConn(ch), 0)
+}
+
+// Close does nothing as the channel belongs to the caller.
+func (c chanConn) Close() error {
+	return nil
+}
+
+// Write sends a copy of the packet on the channel.
+func (c chanConn) Write(b []byte) (int, error) {
+	packet := make([]byte, len(b))
+	copy(packet, b)
+	c <- packet
+	return len(b), nil
+}
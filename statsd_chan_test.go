@@ -0,0 +1,28 @@
+package metrics
+
+import "testing"
+
+func TestChannelClient(t *testing.T) {
+	ch := make(chan []byte, 1)
+	c := NewChannelClient(ch)
+	if err := c.Increment("foo", 1, 1); nil != err {
+		t.Fatal(err)
+	}
+	if err := c.GaugeInt64("bar", 2, 1); nil != err {
+		t.Fatal(err)
+	}
+	if err := c.GaugeFloat64("baz", 1.5, 1); nil != err {
+		t.Fatal(err)
+	}
+	select {
+	case packet := <-ch:
+		t.Fatalf("%q sent before Close", packet)
+	default:
+	}
+	if err := c.Close(); nil != err {
+		t.Fatal(err)
+	}
+	if packet := <-ch; "foo:1|c\nbar:2|g\nbaz:1.5|g" != string(packet) {
+		t.Fatalf("%q", packet)
+	}
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// statsdDiagnostics is the JSON served by StatsdDiagnosticsHandler.
+type statsdDiagnostics struct {
+	LastFlush time.Time              `json:"last_flush"`
+	LastError string                 `json:"last_error,omitempty"`
+	Flushes   int64                  `json:"flushes"`
+	BytesSent int64                  `json:"bytes_sent"`
+	Config    statsdDiagnosticConfig `json:"config"`
+}
+
+// statsdDiagnosticConfig is the part of a StatsdConfig that's served by
+// StatsdDiagnosticsHandler.
+type statsdDiagnosticConfig struct {
+	Addr          string            `json:"addr"`
+	Transport     string            `json:"transport,omitempty"`
+	FlushInterval string            `json:"flush_interval"`
+	Prefix        string            `json:"prefix"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+// StatsdDiagnosticsHandler returns an http.Handler which serves JSON
+// describing the given reporter: when it last flushed and the error, if any,
+// that flush returned, how many times it's flushed and bytes it's sent, and
+// the most interesting parts of its current configuration.
+func StatsdDiagnosticsHandler(reporter *StatsdReporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		reporter.mutex.Lock()
+		d := statsdDiagnostics{
+			LastFlush: reporter.lastFlush,
+			Flushes:   reporter.flushes,
+			BytesSent: reporter.bytesSent,
+			Config: statsdDiagnosticConfig{
+				Addr:          reporter.c.Addr,
+				Transport:     reporter.c.Transport,
+				FlushInterval: reporter.c.FlushInterval.String(),
+				Prefix:        reporter.c.Prefix,
+				Tags:          reporter.c.Tags,
+			},
+		}
+		if nil != reporter.lastErr {
+			d.LastError = reporter.lastErr.Error()
+		}
+		reporter.mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d)
+	})
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatsdDiagnosticsHandler(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredGauge("foo", r).Update(1)
+	clock := newFakeClock()
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		Tags:          map[string]string{"env": "prod"},
+		Clock:         clock,
+	})
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+	packets := server.Packets()
+	w := httptest.NewRecorder()
+	StatsdDiagnosticsHandler(reporter).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if "application/json" != w.Header().Get("Content-Type") {
+		t.Fatal(w.Header())
+	}
+	var d struct {
+		LastFlush time.Time `json:"last_flush"`
+		LastError string    `json:"last_error"`
+		Flushes   int64     `json:"flushes"`
+		BytesSent int       `json:"bytes_sent"`
+		Config    struct {
+			Addr          string            `json:"addr"`
+			FlushInterval string            `json:"flush_interval"`
+			Prefix        string            `json:"prefix"`
+			Tags          map[string]string `json:"tags"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &d); nil != err {
+		t.Fatal(err, w.Body.String())
+	}
+	if !d.LastFlush.Equal(clock.Now()) || "" != d.LastError || 1 != d.Flushes {
+		t.Fatal(w.Body.String())
+	}
+	if 1 != len(packets) || len(packets[0]) != d.BytesSent {
+		t.Fatal(packets, w.Body.String())
+	}
+	if server.Addr() != d.Config.Addr || "1s" != d.Config.FlushInterval || "p" != d.Config.Prefix || "prod" != d.Config.Tags["env"] {
+		t.Fatal(w.Body.String())
+	}
+}
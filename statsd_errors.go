@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StatsdErrorCategory classifies the errors returned and passed to OnError by
+// the statsd exporter so callers can tell them apart.
+type StatsdErrorCategory int
+
+const (
+	// StatsdErrorDial errors come from resolving or connecting to a statsd
+	// server.
+	StatsdErrorDial StatsdErrorCategory = iota
+
+	// StatsdErrorWrite errors come from sending metrics to a statsd server.
+	StatsdErrorWrite
+
+	// StatsdErrorFlush errors come from flushes which didn't report every
+	// metric, because they ran out of time or reporting one panicked.
+	StatsdErrorFlush
+
+	// StatsdErrorEncode errors come from metrics which couldn't be encoded
+	// as-is, such as those whose names collide or infos with invalid labels.
+	StatsdErrorEncode
+
+	// StatsdErrorConfig errors come from the StatsdConfig, such as its Tags
+	// being invalid.
+	StatsdErrorConfig
+)
+
+// String returns the category's name.
+func (c StatsdErrorCategory) String() string {
+	switch c {
+	case StatsdErrorDial:
+		return "dial"
+	case StatsdErrorWrite:
+		return "write"
+	case StatsdErrorFlush:
+		return "flush"
+	case StatsdErrorEncode:
+		return "encode"
+	case StatsdErrorConfig:
+		return "config"
+	}
+	return fmt.Sprintf("StatsdErrorCategory(%d)", int(c))
+}
+
+// StatsdError is an error from the statsd exporter with its category.  It
+// wraps the underlying error so errors.Is and errors.As see through it.
+type StatsdError struct {
+	Category StatsdErrorCategory
+	Err      error
+}
+
+func (err *StatsdError) Error() string {
+	return fmt.Sprintf("statsd %s: %v", err.Category, err.Err)
+}
+
+// Unwrap returns the underlying error.
+func (err *StatsdError) Unwrap() error {
+	return err.Err
+}
+
+// StatsdErrors are the errors from each target a single flush failed to
+// send to, aggregated so that one failing target doesn't hide another's.
+// errors.Is and errors.As see through them to each error.
+type StatsdErrors []*StatsdError
+
+func (errs StatsdErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Unwrap returns the errors aggregated.
+func (errs StatsdErrors) Unwrap() []error {
+	unwrapped := make([]error, len(errs))
+	for i, err := range errs {
+		unwrapped[i] = err
+	}
+	return unwrapped
+}
+
+// errorOrNil returns nil if there are no errors, the only error if there's
+// just one, as there always is with a single target, or else the errors.
+func (errs StatsdErrors) errorOrNil() error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return errs
+}
@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsdErrorDial(t *testing.T) {
+	err := NewStatsdReporter(StatsdConfig{
+		Addr:          "127.0.0.1:8125",
+		Registry:      NewRegistry(),
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		Dialer: func(network, addr string) (net.Conn, error) {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("refused")}
+		},
+	}).flush()
+	var statsdErr *StatsdError
+	if !errors.As(err, &statsdErr) || StatsdErrorDial != statsdErr.Category {
+		t.Fatal(err)
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || "dial" != opErr.Op {
+		t.Fatal(err)
+	}
+	if "statsd dial: dial udp: refused" != err.Error() {
+		t.Fatal(err)
+	}
+}
+
+func TestStatsdErrorFlush(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredGauge("foo", r).Update(1)
+	var errs []error
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		BeforeFlush:   func(Registry) { panic("oops") },
+		OnError:       func(err error) { errs = append(errs, err) },
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	var statsdErr *StatsdError
+	if 1 != len(errs) || !errors.As(errs[0], &statsdErr) || StatsdErrorFlush != statsdErr.Category {
+		t.Fatal(errs)
+	}
+}
+
+func TestStatsdErrorsAggregated(t *testing.T) {
+	err := NewStatsdReporter(StatsdConfig{
+		Registry:      NewRegistry(),
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		Targets:       []StatsdTarget{{Addr: "127.0.0.1:8125"}, {Addr: "127.0.0.1:8126"}},
+		Dialer: func(network, addr string) (net.Conn, error) {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New(addr)}
+		},
+	}).flush()
+	var errs StatsdErrors
+	if !errors.As(err, &errs) || 2 != len(errs) {
+		t.Fatal(err)
+	}
+	for _, err := range errs {
+		if StatsdErrorDial != err.Category {
+			t.Fatal(err)
+		}
+	}
+	var statsdErr *StatsdError
+	if !errors.As(err, &statsdErr) {
+		t.Fatal(err)
+	}
+	if "statsd dial: dial udp: 127.0.0.1:8125; statsd dial: dial udp: 127.0.0.1:8126" != err.Error() {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import "io"
+
+// fanoutQueueSize is the most packets a fanoutConn holds before Write waits
+// for them to be sent.
+const fanoutQueueSize = 64
+
+// fanoutConn sends the packets written to it from a goroutine of its own,
+// taking one of a pool of workers shared between targets for each, so that
+// a flush to several targets isn't held up by the slowest.
+type fanoutConn struct {
+	io.WriteCloser
+	done    chan struct{}
+	err     error
+	packets chan []byte
+	workers chan struct{}
+}
+
+func newFanoutConn(conn io.WriteCloser, workers chan struct{}) *fanoutConn {
+	c := &fanoutConn{
+		WriteCloser: conn,
+		done:        make(chan struct{}),
+		packets:     make(chan []byte, fanoutQueueSize),
+		workers:     workers,
+	}
+	go c.run()
+	return c
+}
+
+// Write queues a copy of the packet to be sent.  Errors sending it are
+// returned by Close.
+func (c *fanoutConn) Write(b []byte) (int, error) {
+	packet := make([]byte, len(b))
+	copy(packet, b)
+	c.packets <- packet
+	return len(b), nil
+}
+
+// Close waits for the packets queued to be sent and then closes the
+// connection, returning the first error sending them or closing it.
+func (c *fanoutConn) Close() error {
+	close(c.packets)
+	<-c.done
+	if err := c.WriteCloser.Close(); nil == c.err {
+		c.err = err
+	}
+	return c.err
+}
+
+func (c *fanoutConn) run() {
+	defer close(c.done)
+	for packet := range c.packets {
+		c.workers <- struct{}{}
+		_, err := c.WriteCloser.Write(packet)
+		<-c.workers
+		if nil != err && nil == c.err {
+			c.err = err
+		}
+	}
+}
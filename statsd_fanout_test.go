@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// blockingConn is a statsdTestConn whose writes wait to be released.
+type blockingConn struct {
+	statsdTestConn
+	release chan struct{}
+	writing chan struct{}
+}
+
+func (c *blockingConn) Write(b []byte) (int, error) {
+	c.writing <- struct{}{}
+	<-c.release
+	return c.statsdTestConn.Write(b)
+}
+
+func TestStatsdFanoutConcurrency(t *testing.T) {
+	slow := &blockingConn{release: make(chan struct{}), writing: make(chan struct{}, 1)}
+	fast := &statsdTestConn{}
+	r := NewRegistry()
+	NewRegisteredCounter("foo", r).Inc(1)
+	reporter := NewStatsdReporter(StatsdConfig{
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		Targets: []StatsdTarget{
+			{Addr: "slow:8125"},
+			{Addr: "fast:8125"},
+		},
+		FanoutConcurrency: 2,
+		Dialer: func(network, addr string) (net.Conn, error) {
+			if "slow:8125" == addr {
+				return slow, nil
+			}
+			return fast, nil
+		},
+	})
+	flushed := make(chan error)
+	go func() {
+		flushed <- reporter.flush()
+	}()
+	<-slow.writing
+	deadline := time.Now().Add(time.Second)
+	for 0 == len(fast.Packets()) {
+		if time.Now().After(deadline) {
+			t.Fatal("the slow target blocked the fast one")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(slow.release)
+	if err := <-flushed; nil != err {
+		t.Fatal(err)
+	}
+	for _, conn := range []*statsdTestConn{&slow.statsdTestConn, fast} {
+		if packets := conn.Packets(); 1 != len(packets) || "p.foo.count:1|c" != packets[0] {
+			t.Fatalf("%q", packets)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+)
+
+// httpConn collects the packets written by a statsd client and POSTs them
+// as a single request body when closed.
+type httpConn struct {
+	body      bytes.Buffer
+	client    *http.Client
+	delimiter byte
+	url       string
+}
+
+func newHTTPConn(client *http.Client, url string, delimiter byte) *httpConn {
+	return &httpConn{client: client, delimiter: delimiter, url: url}
+}
+
+// Close POSTs the packets written so far, if any.
+func (c *httpConn) Close() error {
+	if 0 == c.body.Len() {
+		return nil
+	}
+	resp, err := c.client.Post(c.url, "text/plain", &c.body)
+	if nil != err {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || 300 <= resp.StatusCode {
+		return fmt.Errorf("statsd: POST %s: %s", c.url, resp.Status)
+	}
+	return nil
+}
+
+// Write appends a packet to the request body.
+func (c *httpConn) Write(b []byte) (int, error) {
+	if 0 < c.body.Len() {
+		c.body.WriteByte(c.delimiter)
+	}
+	return c.body.Write(b)
+}
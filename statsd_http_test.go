@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatsdHTTP(t *testing.T) {
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies <- string(body)
+	}))
+	defer server.Close()
+	r := NewRegistry()
+	for _, name := range []string{"foo", "bar", "baz"} {
+		NewRegisteredGaugeFloat64(name, r).Update(1234567.125)
+	}
+	c := StatsdConfig{
+		Addr:          server.URL,
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		Transport:     "http",
+		WriteTimeout:  time.Second,
+	}
+	if err := NewStatsdReporter(c).flush(); nil != err {
+		t.Fatal(err)
+	}
+	lines := statsdLines([]string{<-bodies})
+	if 3 != len(lines) {
+		t.Fatal(lines)
+	}
+	for _, name := range []string{"foo", "bar", "baz"} {
+		if !lines["p."+name+".value:1234567.125|g"] {
+			t.Fatal(lines)
+		}
+	}
+}
+
+func TestStatsdHTTPError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredGauge("foo", r).Update(1)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:          server.URL,
+		Registry:      r,
+		FlushInterval: time.Second,
+		Transport:     "http",
+	}).flush(); nil == err {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"log"
+	"time"
+)
+
+// ClientMiddleware wraps a StatsClient with cross-cutting behavior, such as
+// logging, counting or retrying sends, returning the wrapped client.
+type ClientMiddleware func(StatsClient) StatsClient
+
+// WrapClient returns c wrapped by each of middleware in turn, the first
+// outermost, so that it sees every call first and the last passes them to c.
+func WrapClient(c StatsClient, middleware ...ClientMiddleware) StatsClient {
+	for i := len(middleware) - 1; 0 <= i; i-- {
+		c = middleware[i](c)
+	}
+	return c
+}
+
+// LoggingMiddleware returns a ClientMiddleware which logs every metric sent
+// through the client it wraps to l, with any error sending it.  The client
+// it returns is a TimingClient if the one it wraps is.
+func LoggingMiddleware(l *log.Logger) ClientMiddleware {
+	return func(c StatsClient) StatsClient {
+		if t, ok := c.(TimingClient); ok {
+			return &loggingTimingClient{loggingClient{c, l}, t}
+		}
+		return &loggingClient{c, l}
+	}
+}
+
+// loggingClient logs the metrics sent through another StatsClient.
+type loggingClient struct {
+	StatsClient
+	l *log.Logger
+}
+
+// Increment logs and sends an increment of the counter for the given bucket.
+func (c *loggingClient) Increment(stat string, count int, rate float64) error {
+	err := c.StatsClient.Increment(stat, count, rate)
+	c.l.Printf("increment %s %d @%g: %v", stat, count, rate, err)
+	return err
+}
+
+// GaugeFloat64 logs and sends a float64 value for the given bucket.
+func (c *loggingClient) GaugeFloat64(stat string, value, rate float64) error {
+	err := c.StatsClient.GaugeFloat64(stat, value, rate)
+	c.l.Printf("gauge %s %g @%g: %v", stat, value, rate, err)
+	return err
+}
+
+// GaugeInt64 logs and sends an int64 value for the given bucket.
+func (c *loggingClient) GaugeInt64(stat string, value int64, rate float64) error {
+	err := c.StatsClient.GaugeInt64(stat, value, rate)
+	c.l.Printf("gauge %s %d @%g: %v", stat, value, rate, err)
+	return err
+}
+
+// loggingTimingClient logs the metrics, timings among them, sent through a
+// TimingClient.
+type loggingTimingClient struct {
+	loggingClient
+	t TimingClient
+}
+
+// TimingDuration logs and sends a timing of the duration d.
+func (c *loggingTimingClient) TimingDuration(stat string, d time.Duration, rate float64) error {
+	err := c.t.TimingDuration(stat, d, rate)
+	c.l.Printf("timing %s %v @%g: %v", stat, d, rate, err)
+	return err
+}
+
+// TimeSince logs and sends a timing of the time elapsed since start.
+func (c *loggingTimingClient) TimeSince(stat string, start time.Time) error {
+	err := c.t.TimeSince(stat, start)
+	c.l.Printf("timing %s since %v: %v", stat, start, err)
+	return err
+}
@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"testing"
+	"time"
+)
+
+// recordingClient is a StatsClient which records the calls made to it,
+// tagged with its name, in a log it may share with others.
+type recordingClient struct {
+	StatsClient
+	name  string
+	calls *[]string
+}
+
+func (c *recordingClient) Increment(stat string, count int, rate float64) error {
+	*c.calls = append(*c.calls, fmt.Sprintf("%s increment %s %d", c.name, stat, count))
+	return c.StatsClient.Increment(stat, count, rate)
+}
+
+func (c *recordingClient) GaugeFloat64(stat string, value, rate float64) error {
+	*c.calls = append(*c.calls, fmt.Sprintf("%s gauge %s %g", c.name, stat, value))
+	return c.StatsClient.GaugeFloat64(stat, value, rate)
+}
+
+func (c *recordingClient) GaugeInt64(stat string, value int64, rate float64) error {
+	*c.calls = append(*c.calls, fmt.Sprintf("%s gauge %s %d", c.name, stat, value))
+	return c.StatsClient.GaugeInt64(stat, value, rate)
+}
+
+func recordingMiddleware(name string, calls *[]string) ClientMiddleware {
+	return func(c StatsClient) StatsClient {
+		return &recordingClient{c, name, calls}
+	}
+}
+
+func TestWrapClient(t *testing.T) {
+	conn := &statsdTestConn{}
+	var calls []string
+	c := WrapClient(
+		newClient(conn, 0),
+		recordingMiddleware("outer", &calls),
+		recordingMiddleware("inner", &calls),
+	)
+	c.Increment("foo", 1, 1)
+	c.GaugeInt64("bar", 2, 1)
+	c.GaugeFloat64("baz", 3.5, 1)
+	if err := c.Close(); nil != err {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"outer increment foo 1",
+		"inner increment foo 1",
+		"outer gauge bar 2",
+		"inner gauge bar 2",
+		"outer gauge baz 3.5",
+		"inner gauge baz 3.5",
+	}
+	if fmt.Sprint(expected) != fmt.Sprint(calls) {
+		t.Fatalf("%q", calls)
+	}
+	if lines := statsdLines(conn.Packets()); 3 != len(lines) || !lines["foo:1|c"] || !lines["bar:2|g"] || !lines["baz:3.5|g"] {
+		t.Fatal(lines)
+	}
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	c := WrapClient(newClient(&statsdTestConn{}, 0), LoggingMiddleware(log.New(&buf, "", 0)))
+	c.Increment("foo", 1, 1)
+	c.GaugeInt64("bar", 2, 0.5)
+	expected := "increment foo 1 @1: <nil>\ngauge bar 2 @0.5: <nil>\n"
+	if s := buf.String(); expected != s {
+		t.Fatalf("%q", s)
+	}
+}
+
+func TestLoggingMiddlewareTiming(t *testing.T) {
+	var buf bytes.Buffer
+	conn := &statsdTestConn{}
+	c := WrapClient(newClient(conn, 0), LoggingMiddleware(log.New(&buf, "", 0)))
+	tc, ok := c.(TimingClient)
+	if !ok {
+		t.Fatalf("%T", c)
+	}
+	tc.TimingDuration("foo", 1500*time.Microsecond, 1)
+	if err := c.Close(); nil != err {
+		t.Fatal(err)
+	}
+	if s := buf.String(); "timing foo 1.5ms @1: <nil>\n" != s {
+		t.Fatalf("%q", s)
+	}
+	if lines := statsdLines(conn.Packets()); 1 != len(lines) || !lines["foo:1.5|ms"] {
+		t.Fatal(lines)
+	}
+	if _, ok := LoggingMiddleware(log.New(&buf, "", 0))(&recordingClient{}).(TimingClient); ok {
+		t.Fatal("not a TimingClient wrapped as one")
+	}
+}
+
+func TestDialMiddleware(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	var calls []string
+	c, err := Dial(server.Addr(), recordingMiddleware("outer", &calls), recordingMiddleware("inner", &calls))
+	if nil != err {
+		t.Fatal(err)
+	}
+	c.Increment("foo", 1, 1)
+	if err := c.Close(); nil != err {
+		t.Fatal(err)
+	}
+	if "[outer increment foo 1 inner increment foo 1]" != fmt.Sprint(calls) {
+		t.Fatalf("%q", calls)
+	}
+	if lines := statsdLines(server.Packets()); 1 != len(lines) || !lines["foo:1|c"] {
+		t.Fatal(lines)
+	}
+}
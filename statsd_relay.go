@@ -0,0 +1,190 @@
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// StatsdLine is a single metric in the statsd line protocol, as in
+// "name:value|type|@rate|#tags".
+type StatsdLine struct {
+	Name  string
+	Value string
+	Type  string   // c, g, ms, d, s, h and so on
+	Rate  float64  // The sample rate, 1 if the line had none
+	Tags  []string // DogStatsD tags, as in "key:value" or "key"
+}
+
+// ParseStatsdLine parses a single statsd metric line.
+func ParseStatsdLine(line string) (StatsdLine, error) {
+	fields := strings.Split(line, "|")
+	colon := strings.LastIndex(fields[0], ":")
+	if len(fields) < 2 || colon <= 0 || len(fields[0])-1 == colon || "" == fields[1] {
+		return StatsdLine{}, fmt.Errorf("statsd: malformed line %q", line)
+	}
+	l := StatsdLine{
+		Name:  fields[0][:colon],
+		Value: fields[0][colon+1:],
+		Type:  fields[1],
+		Rate:  1,
+	}
+	for _, field := range fields[2:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			rate, err := strconv.ParseFloat(field[1:], 64)
+			if nil != err || rate <= 0 || 1 < rate {
+				return StatsdLine{}, fmt.Errorf("statsd: malformed sample rate in line %q", line)
+			}
+			l.Rate = rate
+		case strings.HasPrefix(field, "#"):
+			if "#" != field {
+				l.Tags = append(l.Tags, strings.Split(field[1:], ",")...)
+			}
+		default:
+			return StatsdLine{}, fmt.Errorf("statsd: unknown field %q in line %q", field, line)
+		}
+	}
+	return l, nil
+}
+
+// String returns the line in the statsd line protocol.
+func (l StatsdLine) String() string {
+	return l.Name + ":" + l.format()
+}
+
+// format returns the line less its name.
+func (l StatsdLine) format() string {
+	format := l.Value + "|" + l.Type
+	if l.Rate < 1 {
+		format += "|@" + strconv.FormatFloat(l.Rate, 'f', -1, 64)
+	}
+	if 0 < len(l.Tags) {
+		format += "|#" + strings.Join(l.Tags, ",")
+	}
+	return format
+}
+
+// StatsdRelayConfig provides a container with configuration parameters for
+// a StatsdRelay.
+type StatsdRelayConfig struct {
+	Addr     string // UDP address to listen on
+	Upstream string // UDP address of the statsd server to forward to
+
+	// StripPrefix is removed from the start of each metric's name, if it's
+	// there, before Prefix, if not empty, is prepended with a dot.
+	StripPrefix string
+	Prefix      string
+
+	// Tags are added to every metric as DogStatsD tags.
+	Tags map[string]string
+
+	// OnError is called with each malformed line or failure to forward,
+	// which are logged if it's nil.
+	OnError func(error)
+}
+
+// StatsdRelay is a lightweight statsd proxy which forwards the metrics it
+// receives to an upstream statsd server, rewriting their names and tags.
+type StatsdRelay struct {
+	c        StatsdRelayConfig
+	closed   bool
+	conn     net.PacketConn
+	mutex    sync.Mutex
+	tags     []string
+	upstream *client
+}
+
+// NewStatsdRelay listens on c.Addr and connects to c.Upstream, returning a
+// StatsdRelay which forwards metrics once Serve is called.
+func NewStatsdRelay(c StatsdRelayConfig) (*StatsdRelay, error) {
+	tags, err := encodeTags(c.Tags, TagFormatDatadog, false)
+	if nil != err {
+		return nil, err
+	}
+	upstream, err := net.Dial("udp", c.Upstream)
+	if nil != err {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp", c.Addr)
+	if nil != err {
+		upstream.Close()
+		return nil, err
+	}
+	r := &StatsdRelay{c: c, conn: conn, upstream: newClient(upstream, 0)}
+	if "" != tags {
+		r.tags = strings.Split(strings.TrimPrefix(tags, "|#"), ",")
+	}
+	return r, nil
+}
+
+// Addr returns the address the relay listens on.
+func (r *StatsdRelay) Addr() net.Addr {
+	return r.conn.LocalAddr()
+}
+
+// Close stops the relay, causing Serve to return.
+func (r *StatsdRelay) Close() error {
+	r.mutex.Lock()
+	r.closed = true
+	r.mutex.Unlock()
+	err := r.conn.Close()
+	if uerr := r.upstream.Close(); nil == err {
+		err = uerr
+	}
+	return err
+}
+
+// Serve forwards every metric received until the relay is closed, sending
+// those from each packet received upstream together.
+func (r *StatsdRelay) Serve() error {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := r.conn.ReadFrom(buf)
+		if nil != err {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			if r.closed {
+				return nil
+			}
+			return err
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if "" != line {
+				r.relay(line)
+			}
+		}
+		if err := r.upstream.Flush(); nil != err {
+			r.onError(err)
+		}
+	}
+}
+
+// relay rewrites and forwards a single line.
+func (r *StatsdRelay) relay(line string) {
+	l, err := ParseStatsdLine(line)
+	if nil != err {
+		r.onError(err)
+		return
+	}
+	if "" != r.c.StripPrefix && strings.HasPrefix(l.Name, r.c.StripPrefix) {
+		l.Name = strings.TrimPrefix(strings.TrimPrefix(l.Name, r.c.StripPrefix), ".")
+	}
+	l.Name = BuildMetricName(r.c.Prefix, l.Name, "", ".")
+	l.Tags = append(l.Tags, r.tags...)
+	if err := r.upstream.sendTagged(l.Name, "", "", 1, l.format()); nil != err {
+		r.onError(err)
+	}
+}
+
+// onError passes err to r.c.OnError or, if that's nil, logs it.
+func (r *StatsdRelay) onError(err error) {
+	if nil == r.c.OnError {
+		log.Println(err)
+		return
+	}
+	r.c.OnError(err)
+}
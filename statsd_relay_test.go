@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseStatsdLine(t *testing.T) {
+	for line, expected := range map[string]StatsdLine{
+		"foo:1|c":                     {Name: "foo", Value: "1", Type: "c", Rate: 1},
+		"foo.bar:-1.5|g|@0.5":         {Name: "foo.bar", Value: "-1.5", Type: "g", Rate: 0.5},
+		"foo:2|ms|@0.1|#env:prod,web": {Name: "foo", Value: "2", Type: "ms", Rate: 0.1, Tags: []string{"env:prod", "web"}},
+	} {
+		l, err := ParseStatsdLine(line)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if expected.String() != l.String() || line != l.String() {
+			t.Errorf("%q: %+v", line, l)
+		}
+	}
+	for _, line := range []string{"", "foo", "foo:1", "foo:|c", ":1|c", "foo:1|", "foo:1|c|@2", "foo:1|c|x"} {
+		if _, err := ParseStatsdLine(line); nil == err {
+			t.Errorf("%q parsed", line)
+		}
+	}
+}
+
+func TestStatsdRelay(t *testing.T) {
+	upstream := newStatsdTestServer(t)
+	defer upstream.Close()
+	var errs []error
+	relay, err := NewStatsdRelay(StatsdRelayConfig{
+		Addr:        "127.0.0.1:0",
+		Upstream:    upstream.Addr(),
+		StripPrefix: "app",
+		Prefix:      "relayed",
+		Tags:        map[string]string{"relay": "a"},
+		OnError:     func(err error) { errs = append(errs, err) },
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- relay.Serve() }()
+	conn, err := net.Dial("udp", relay.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("app.foo:1|c\nbar:2|g|@0.5|#env:prod\nmalformed"))
+	packets := upstream.Packets()
+	if err := relay.Close(); nil != err {
+		t.Fatal(err)
+	}
+	if err := <-done; nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(packets) || "relayed.foo:1|c|#relay:a\nrelayed.bar:2|g|@0.5|#env:prod,relay:a" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+	if 1 != len(errs) {
+		t.Fatal(errs)
+	}
+}
+
+func FuzzStatsdRoundTrip(f *testing.F) {
+	f.Add("foo.bar", 1.5, "env", "prod", false, byte('\n'), uint8(255))
+	f.Add("foo:bar|baz\nqux", -1e-9, "k:ey", "v,al|#ue", false, byte(0), uint8(8))
+	f.Add("@#", 1e300, "", "orphan", true, byte('\n'), uint8(255))
+	f.Add("%s%d", 0.0, "canary", "", false, byte(' '), uint8(255))
+	f.Add("a,b", 2.0, "route", "a|b:c", true, byte(','), uint8(16))
+	f.Add("x", 3.0, "url", "http://x:1/~y", true, byte('\n'), uint8(0))
+	f.Fuzz(func(t *testing.T, name string, value float64, key, tagValue string, graphite bool, delimiter byte, size uint8) {
+		if "" == name {
+			return
+		}
+
+		// Delimiters which are part of the line protocol, the tag formats
+		// or the values sent, or which are what's replaced, can't be used.
+		if delimiter < ' ' && 0 != delimiter || 0x7f <= delimiter ||
+			strings.IndexByte("0123456789.+-_~!^:|@#,;=", delimiter) >= 0 ||
+			'A' <= delimiter && delimiter <= 'Z' || 'a' <= delimiter && delimiter <= 'z' {
+			delimiter = '\n'
+		}
+
+		// Each metric is sent alone so, however small the packets, it's
+		// sent whole in one of its own.
+		conn := &statsdTestConn{}
+		c := newClient(conn, int(size)+1)
+		c.setDelimiter(delimiter)
+		tags := map[string]string{key: tagValue}
+		if graphite {
+			c.tagFormat = TagFormatGraphite
+			c.nameTags, _ = encodeTags(tags, TagFormatGraphite, false)
+		} else {
+			c.tagFormat = TagFormatDatadog
+			c.tags, _ = encodeTags(tags, TagFormatDatadog, false)
+		}
+		c.GaugeFloat64(name, value, 1)
+		if err := c.Close(); nil != err {
+			t.Fatal(err)
+		}
+		packets := conn.Packets()
+		if 1 != len(packets) || 1 != len(strings.Split(packets[0], string(delimiter))) {
+			t.Fatalf("%q", packets)
+		}
+		l, err := ParseStatsdLine(packets[0])
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		// What's expected is worked out from the inputs, apart from the
+		// replacers used to send them.
+		replace := func(s, chars string) string {
+			b := []byte(s)
+			for i := range b {
+				if strings.IndexByte(chars, b[i]) >= 0 || delimiter == b[i] {
+					b[i] = '_'
+				}
+			}
+			return string(b)
+		}
+		expected := StatsdLine{
+			Name:  replace(name, ":|\n"),
+			Value: strconv.FormatFloat(value, 'f', -1, 64),
+			Type:  "g",
+			Rate:  1,
+		}
+		if graphite {
+			if "" != key && "" != tagValue {
+				v := replace(tagValue, "; :|\n")
+				if strings.HasPrefix(v, "~") {
+					v = "_" + v[1:]
+				}
+				expected.Name += ";" + replace(key, ";!^= :|\n") + "=" + v
+			}
+		} else if "" != key {
+			tag := replace(key, " ,|#\n:")
+			if "" != tagValue {
+				tag += ":" + replace(tagValue, " ,|#\n")
+			}
+			expected.Tags = []string{tag}
+		}
+		if !reflect.DeepEqual(expected, l) {
+			t.Fatalf("%q: %+v != %+v", packets[0], l, expected)
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// retryConnAttempts is the most times retryConn retries a write and
+// retryConnBackoff how long it first waits, doubling each time.
+const (
+	retryConnAttempts = 5
+	retryConnBackoff  = time.Millisecond
+)
+
+// retryConn retries writes which fail because the kernel's socket buffer is
+// full, as UDP writes do under bursts, after waiting for it to drain.
+type retryConn struct {
+	io.WriteCloser
+}
+
+// Write writes b, retrying with backoff while the socket buffer is full.
+func (c retryConn) Write(b []byte) (n int, err error) {
+	backoff := retryConnBackoff
+	for attempt := 0; ; attempt++ {
+		n, err = c.WriteCloser.Write(b)
+		if nil == err || retryConnAttempts <= attempt || !isBufferFull(err) {
+			return n, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isBufferFull reports whether err means a write found the socket buffer
+// full and may succeed if retried.
+func isBufferFull(err error) bool {
+	return errors.Is(err, syscall.ENOBUFS) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EWOULDBLOCK)
+}
+
+// isBackpressure reports whether err means a write couldn't be made without
+// waiting on the server, because the socket buffer was full or the write
+// timed out.
+func isBackpressure(err error) bool {
+	var netErr net.Error
+	return isBufferFull(err) || errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// bufferFullConn fails its first writes as though the socket buffer were
+// full.
+type bufferFullConn struct {
+	statsdTestConn
+	failures int
+	err      error
+}
+
+func (c *bufferFullConn) Write(b []byte) (int, error) {
+	if 0 < c.failures {
+		c.failures--
+		return 0, c.err
+	}
+	return c.statsdTestConn.Write(b)
+}
+
+func TestRetryConn(t *testing.T) {
+	conn := &bufferFullConn{
+		failures: 2,
+		err:      &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("write", syscall.ENOBUFS)},
+	}
+	c := newClient(retryConn{conn}, 0)
+	c.Increment("foo", 1, 1)
+	if err := c.Close(); nil != err {
+		t.Fatal(err)
+	}
+	if packets := conn.Packets(); 1 != len(packets) || "foo:1|c" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestRetryConnOtherErrors(t *testing.T) {
+	failure := errors.New("connection refused")
+	conn := &bufferFullConn{failures: 1, err: failure}
+	if _, err := (retryConn{conn}).Write([]byte("foo:1|c")); failure != err {
+		t.Fatal(err)
+	}
+	if packets := conn.Packets(); 0 != len(packets) {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestRetryConnGivesUp(t *testing.T) {
+	conn := &bufferFullConn{failures: retryConnAttempts + 1, err: syscall.EAGAIN}
+	if _, err := (retryConn{conn}).Write([]byte("foo:1|c")); syscall.EAGAIN != err {
+		t.Fatal(err)
+	}
+}
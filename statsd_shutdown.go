@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// statsdShutdown flushes a StatsdReporter one last time when the process is
+// signalled to terminate.
+type statsdShutdown struct {
+	r       *StatsdReporter
+	signals chan os.Signal
+	done    chan struct{}
+	once    sync.Once
+
+	// raise redelivers the signal once it's been handled, os.Process.Signal
+	// to the process itself but for tests.
+	raise func(os.Signal)
+}
+
+// ShutdownOnSignal stops the reporter, flushes it one last time and closes
+// its connections when the process receives one of the given signals,
+// SIGTERM or SIGINT if none are given, so that containerized services don't
+// lose their last metrics on termination.  Handling of the signal is then
+// restored to what it was and the signal redelivered, so the process still
+// terminates unless it handles the signal itself, in which case it sees it
+// twice.
+//
+// The returned function restores handling of the signals without flushing,
+// and does nothing once either has happened.
+func (r *StatsdReporter) ShutdownOnSignal(signals ...os.Signal) (stop func()) {
+	if 0 == len(signals) {
+		signals = []os.Signal{syscall.SIGTERM, os.Interrupt}
+	}
+	s := newStatsdShutdown(r)
+	signal.Notify(s.signals, signals...)
+	go s.wait()
+	return s.stop
+}
+
+func newStatsdShutdown(r *StatsdReporter) *statsdShutdown {
+	return &statsdShutdown{
+		r:       r,
+		signals: make(chan os.Signal, 1),
+		done:    make(chan struct{}),
+		raise: func(sig os.Signal) {
+			if p, err := os.FindProcess(os.Getpid()); nil == err {
+				p.Signal(sig)
+			}
+		},
+	}
+}
+
+// wait shuts the reporter down when a signal arrives, unless stop is called
+// first.
+func (s *statsdShutdown) wait() {
+	select {
+	case sig := <-s.signals:
+		s.shutdown(sig)
+	case <-s.done:
+	}
+}
+
+// shutdown stops the reporter, flushes it, restores handling of the signal
+// and redelivers it.
+func (s *statsdShutdown) shutdown(sig os.Signal) {
+	s.once.Do(func() {
+		s.r.Stop()
+		if err := s.r.flush(); nil != err {
+			c := s.r.config()
+			c.onError(err)
+		}
+		signal.Stop(s.signals)
+		s.raise(sig)
+	})
+}
+
+// stop restores handling of the signals without flushing.
+func (s *statsdShutdown) stop() {
+	s.once.Do(func() {
+		signal.Stop(s.signals)
+		close(s.done)
+	})
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStatsdShutdownOnSignal(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredCounter("foo", r).Inc(47)
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Hour,
+		Prefix:        "p",
+	})
+	ran := make(chan struct{})
+	go func() {
+		reporter.Run()
+		close(ran)
+	}()
+	raised := make(chan os.Signal, 1)
+	s := newStatsdShutdown(reporter)
+	s.raise = func(sig os.Signal) {
+		raised <- sig
+	}
+	go s.wait()
+	s.signals <- syscall.SIGTERM
+	if sig := <-raised; syscall.SIGTERM != sig {
+		t.Fatal(sig)
+	}
+	<-ran
+	if packets := server.Packets(); 1 != len(packets) || "p.foo.count:47|c" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+	s.stop()
+	reporter.Stop()
+}
+
+func TestStatsdShutdownStop(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredCounter("foo", r).Inc(47)
+	s := newStatsdShutdown(NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Hour,
+	}))
+	s.raise = func(sig os.Signal) {
+		t.Fatal(sig)
+	}
+	waited := make(chan struct{})
+	go func() {
+		s.wait()
+		close(waited)
+	}()
+	s.stop()
+	<-waited
+	s.shutdown(syscall.SIGTERM)
+	s.stop()
+	if packets := server.Packets(); 0 != len(packets) {
+		t.Fatalf("%q", packets)
+	}
+}
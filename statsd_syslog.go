@@ -0,0 +1,80 @@
+//go:build !windows
+// +build !windows
+
+package metrics
+
+import (
+	"bytes"
+	"log/syslog"
+)
+
+// syslogWriter is the part of *syslog.Writer a syslogConn writes through.
+type syslogWriter interface {
+	Emerg(string) error
+	Alert(string) error
+	Crit(string) error
+	Err(string) error
+	Warning(string) error
+	Notice(string) error
+	Info(string) error
+	Debug(string) error
+	Close() error
+}
+
+// syslogConn writes each metric in the packets written to it as a syslog
+// message at a fixed severity.
+type syslogConn struct {
+	w        syslogWriter
+	priority syslog.Priority
+}
+
+// NewSyslogClient returns a StatsClient which, instead of writing to a
+// socket, logs each metric, formatted in the statsd line protocol, to w at
+// the severity of the given priority, so metrics land in an existing log
+// pipeline.  The priority's facility is w's.  Close closes w.
+func NewSyslogClient(w *syslog.Writer, priority syslog.Priority) StatsClient {
+	return newSyslogClient(w, priority)
+}
+
+func newSyslogClient(w syslogWriter, priority syslog.Priority) *client {
+	return newClient(&syslogConn{w, priority}, 0)
+}
+
+// Close closes the syslog writer.
+func (c *syslogConn) Close() error {
+	return c.w.Close()
+}
+
+// Write logs each newline-delimited metric in the packet.
+func (c *syslogConn) Write(b []byte) (int, error) {
+	for _, line := range bytes.Split(b, []byte{'\n'}) {
+		if 0 == len(line) {
+			continue
+		}
+		if err := c.log(string(line)); nil != err {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// log logs the message at c's severity.
+func (c *syslogConn) log(m string) error {
+	switch c.priority & 7 {
+	case syslog.LOG_EMERG:
+		return c.w.Emerg(m)
+	case syslog.LOG_ALERT:
+		return c.w.Alert(m)
+	case syslog.LOG_CRIT:
+		return c.w.Crit(m)
+	case syslog.LOG_ERR:
+		return c.w.Err(m)
+	case syslog.LOG_WARNING:
+		return c.w.Warning(m)
+	case syslog.LOG_NOTICE:
+		return c.w.Notice(m)
+	case syslog.LOG_INFO:
+		return c.w.Info(m)
+	}
+	return c.w.Debug(m)
+}
@@ -0,0 +1,54 @@
+//go:build !windows
+// +build !windows
+
+package metrics
+
+import (
+	"fmt"
+	"log/syslog"
+	"testing"
+)
+
+// recordingSyslogWriter records the messages logged through it with their
+// severities.
+type recordingSyslogWriter struct {
+	closed   bool
+	messages []string
+}
+
+func (w *recordingSyslogWriter) record(severity, m string) error {
+	w.messages = append(w.messages, severity+" "+m)
+	return nil
+}
+
+func (w *recordingSyslogWriter) Emerg(m string) error   { return w.record("emerg", m) }
+func (w *recordingSyslogWriter) Alert(m string) error   { return w.record("alert", m) }
+func (w *recordingSyslogWriter) Crit(m string) error    { return w.record("crit", m) }
+func (w *recordingSyslogWriter) Err(m string) error     { return w.record("err", m) }
+func (w *recordingSyslogWriter) Warning(m string) error { return w.record("warning", m) }
+func (w *recordingSyslogWriter) Notice(m string) error  { return w.record("notice", m) }
+func (w *recordingSyslogWriter) Info(m string) error    { return w.record("info", m) }
+func (w *recordingSyslogWriter) Debug(m string) error   { return w.record("debug", m) }
+
+func (w *recordingSyslogWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestSyslogClient(t *testing.T) {
+	w := &recordingSyslogWriter{}
+	c := newSyslogClient(w, syslog.LOG_LOCAL0|syslog.LOG_NOTICE)
+	c.Increment("foo", 1, 1)
+	c.GaugeInt64("bar", 47, 1)
+	c.GaugeFloat64("baz", 1.5, 1)
+	if err := c.Close(); nil != err {
+		t.Fatal(err)
+	}
+	expected := []string{"notice foo:1|c", "notice bar:47|g", "notice baz:1.5|g"}
+	if fmt.Sprint(expected) != fmt.Sprint(w.messages) {
+		t.Fatalf("%q", w.messages)
+	}
+	if !w.closed {
+		t.Fatal("writer not closed")
+	}
+}
@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TagFormat selects how, if at all, tags are encoded into statsd metrics.
+type TagFormat int
+
+const (
+	// TagFormatNone drops tags, as vanilla statsd doesn't understand them.
+	TagFormatNone TagFormat = iota
+
+	// TagFormatDatadog appends tags in DogStatsD's "|#key:value,..." form.
+	TagFormatDatadog
+
+	// TagFormatGraphite appends tags to the metric name in Graphite 1.1's
+	// ";key=value;..." form.
+	TagFormatGraphite
+
+	// TagFormatTelegraf appends tags in DogStatsD's form for Telegraf's
+	// statsd input with datadog_extensions enabled.  Unlike
+	// TagFormatDatadog, spaces and equals signs are kept, escaped with
+	// backslashes as in the InfluxDB line protocol Telegraf converts
+	// metrics to, rather than replaced with underscores.
+	TagFormatTelegraf
+)
+
+// InvalidTag is the error returned when a tag can't be encoded as-is.
+type InvalidTag struct {
+	Key, Value string
+}
+
+func (err InvalidTag) Error() string {
+	return fmt.Sprintf("invalid tag: %q:%q", err.Key, err.Value)
+}
+
+// datadogTagReplacer replaces the characters which can't appear in DogStatsD
+// tag keys or values.
+var datadogTagReplacer = strings.NewReplacer(
+	" ", "_",
+	",", "_",
+	"|", "_",
+	"#", "_",
+	"\n", "_",
+)
+
+// telegrafTagReplacer escapes the characters the InfluxDB line protocol
+// requires escaped in tag keys and values and replaces those which can't
+// appear in DogStatsD tags.
+var telegrafTagReplacer = strings.NewReplacer(
+	" ", `\ `,
+	"=", `\=`,
+	",", "_",
+	"|", "_",
+	"#", "_",
+	"\n", "_",
+)
+
+// graphiteTagKeyReplacer and graphiteTagValueReplacer replace the characters
+// which can't appear in Graphite tag keys and values, respectively, or which
+// would break the plaintext protocol or, as the tags follow the name, the
+// statsd line.
+var (
+	graphiteTagKeyReplacer = strings.NewReplacer(
+		";", "_",
+		"!", "_",
+		"^", "_",
+		"=", "_",
+		" ", "_",
+		":", "_",
+		"|", "_",
+		"\n", "_",
+	)
+	graphiteTagValueReplacer = strings.NewReplacer(
+		";", "_",
+		" ", "_",
+		":", "_",
+		"|", "_",
+		"\n", "_",
+	)
+)
+
+// encodeTags returns the suffix encoding tags in the given format.  Keys and
+// values containing characters the format can't carry are sanitized unless
+// skipInvalid is set, in which case such tags are left out and reported by
+// the returned error.  Empty keys are always invalid and empty values are
+// only valid when sanitizing into TagFormatDatadog, which encodes the key
+// alone.
+func encodeTags(tags map[string]string, format TagFormat, skipInvalid bool) (string, error) {
+	if TagFormatNone == format || 0 == len(tags) {
+		return "", nil
+	}
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var (
+		encoded []string
+		err     error
+	)
+	for _, key := range keys {
+		value := tags[key]
+		var sanitizedKey, sanitizedValue string
+		var replaced bool
+		if TagFormatGraphite == format {
+			sanitizedKey = graphiteTagKeyReplacer.Replace(key)
+			sanitizedValue = graphiteTagValueReplacer.Replace(value)
+			if strings.HasPrefix(sanitizedValue, "~") {
+				sanitizedValue = "_" + sanitizedValue[1:]
+			}
+			replaced = sanitizedKey != key || sanitizedValue != value
+		} else if TagFormatTelegraf == format {
+			sanitizedKey = telegrafTagReplacer.Replace(strings.Replace(key, ":", "_", -1))
+			sanitizedValue = telegrafTagReplacer.Replace(value)
+
+			// Escaping spaces and equals signs keeps them, so only the
+			// characters replaced make a tag invalid.
+			replaced = strings.ContainsAny(key, ":,|#\n") || strings.ContainsAny(value, ",|#\n")
+		} else {
+			sanitizedKey = datadogTagReplacer.Replace(strings.Replace(key, ":", "_", -1))
+			sanitizedValue = datadogTagReplacer.Replace(value)
+			replaced = sanitizedKey != key || sanitizedValue != value
+		}
+		if "" == key ||
+			"" == value && (skipInvalid || TagFormatGraphite == format) ||
+			skipInvalid && replaced {
+			if nil == err {
+				err = InvalidTag{key, value}
+			}
+			continue
+		}
+		if TagFormatGraphite == format {
+			encoded = append(encoded, ";"+sanitizedKey+"="+sanitizedValue)
+		} else if "" == value {
+			encoded = append(encoded, sanitizedKey)
+		} else {
+			encoded = append(encoded, sanitizedKey+":"+sanitizedValue)
+		}
+	}
+	if 0 == len(encoded) {
+		return "", err
+	}
+	if TagFormatGraphite == format {
+		return strings.Join(encoded, ""), err
+	}
+	return "|#" + strings.Join(encoded, ","), err
+}
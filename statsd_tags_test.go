@@ -0,0 +1,281 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEncodeTagsSanitize(t *testing.T) {
+	tags := map[string]string{
+		"env":    "prod",
+		"region": "us east",
+		"hosts":  "a,b",
+		"canary": "",
+		"":       "orphan",
+	}
+	encoded, err := encodeTags(tags, TagFormatDatadog, false)
+	if _, ok := err.(InvalidTag); !ok {
+		t.Error(err)
+	}
+	if "|#canary,env:prod,hosts:a_b,region:us_east" != encoded {
+		t.Error(encoded)
+	}
+}
+
+func TestEncodeTagsSkipInvalid(t *testing.T) {
+	for _, tags := range []map[string]string{
+		{"env": "prod", "region": "us east"},
+		{"env": "prod", "hosts": "a,b"},
+		{"env": "prod", "canary": ""},
+	} {
+		encoded, err := encodeTags(tags, TagFormatDatadog, true)
+		if _, ok := err.(InvalidTag); !ok {
+			t.Error(tags, err)
+		}
+		if "|#env:prod" != encoded {
+			t.Error(tags, encoded)
+		}
+	}
+}
+
+func TestEncodeTagsNone(t *testing.T) {
+	if encoded, err := encodeTags(map[string]string{"env": "prod"}, TagFormatNone, true); "" != encoded || nil != err {
+		t.Error(encoded, err)
+	}
+}
+
+func TestStatsdTags(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredGauge("foo", r).Update(1)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		Tags:          map[string]string{"env": "prod", "region": "us east"},
+		TagFormat:     TagFormatDatadog,
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	packets := server.Packets()
+	if 1 != len(packets) || "p.foo.value:1|g|#env:prod,region:us_east" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestStatsdTagsSkipInvalid(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredGauge("foo", r).Update(1)
+	err := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		Tags:          map[string]string{"env": "prod", "region": "us east"},
+		TagFormat:     TagFormatDatadog,
+		SkipInvalid:   true,
+	}).flush()
+	var invalid InvalidTag
+	if !errors.As(err, &invalid) {
+		t.Fatal(err)
+	}
+	packets := server.Packets()
+	if 1 != len(packets) || "p.foo.value:1|g|#env:prod" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestEncodeTagsGraphite(t *testing.T) {
+	tags := map[string]string{
+		"env":       "prod",
+		"region":    "us east",
+		"a;b=c":     "d;e",
+		"negated":   "~x",
+		"canary":    "",
+		"":          "orphan",
+		"hosts":     "a,b",
+		"timestamp": "x=y",
+	}
+	encoded, err := encodeTags(tags, TagFormatGraphite, false)
+	if _, ok := err.(InvalidTag); !ok {
+		t.Error(err)
+	}
+	if ";a_b_c=d_e;env=prod;hosts=a,b;negated=_x;region=us_east;timestamp=x=y" != encoded {
+		t.Error(encoded)
+	}
+}
+
+func TestEncodeTagsGraphiteSkipInvalid(t *testing.T) {
+	encoded, err := encodeTags(map[string]string{"env": "prod", "region": "us east"}, TagFormatGraphite, true)
+	if _, ok := err.(InvalidTag); !ok {
+		t.Error(err)
+	}
+	if ";env=prod" != encoded {
+		t.Error(encoded)
+	}
+}
+
+func TestStatsdTagsGraphite(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredGauge("foo", r).Update(1)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		Tags:          map[string]string{"env": "prod", "region": "us east"},
+		TagFormat:     TagFormatGraphite,
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	packets := server.Packets()
+	if 1 != len(packets) || "p.foo.value;env=prod;region=us_east:1|g" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestStatsdTagsGraphiteSanitized(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredGauge("bar", r).Update(1)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:            server.Addr(),
+		Registry:        r,
+		FlushInterval:   time.Second,
+		Prefix:          "p",
+		Tags:            map[string]string{"route": "a|b:c", "url": "http://x:1,2", "a:b": "c"},
+		TagFormat:       TagFormatGraphite,
+		MetricDelimiter: ',',
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	packets := server.Packets()
+	if 1 != len(packets) || "p.bar.value;a_b=c;route=a_b_c;url=http_//x_1_2:1|g" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestEncodeTagsTelegraf(t *testing.T) {
+	tags := map[string]string{
+		"env":    "prod",
+		"region": "us east",
+		"query":  "a=b",
+		"hosts":  "a,b",
+	}
+	encoded, err := encodeTags(tags, TagFormatTelegraf, false)
+	if nil != err {
+		t.Error(err)
+	}
+	if `|#env:prod,hosts:a_b,query:a\=b,region:us\ east` != encoded {
+		t.Error(encoded)
+	}
+}
+
+func TestEncodeTagsTelegrafSkipInvalid(t *testing.T) {
+	encoded, err := encodeTags(map[string]string{"region": "us east", "hosts": "a,b"}, TagFormatTelegraf, true)
+	if (InvalidTag{"hosts", "a,b"}) != err {
+		t.Error(err)
+	}
+	if `|#region:us\ east` != encoded {
+		t.Error(encoded)
+	}
+}
+
+func TestStatsdMaxTagCardinality(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r, self := NewRegistry(), NewRegistry()
+	for _, route := range []string{"/a", "/b", "/c"} {
+		ctx := WithTags(context.Background(), map[string]string{"route": route})
+		GetOrRegisterTagged(ctx, r, "requests", NewCounter).(Counter).Inc(1)
+	}
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:              server.Addr(),
+		Registry:          r,
+		FlushInterval:     time.Second,
+		Prefix:            "p",
+		Tags:              map[string]string{"env": "prod"},
+		TagFormat:         TagFormatDatadog,
+		MaxTagCardinality: 2,
+		SortedOutput:      true,
+		SelfRegistry:      self,
+	})
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+	lines := statsdLines(server.Packets())
+	if 3 != len(lines) ||
+		!lines["p.requests.count:1|c|#env:prod,route:/a"] ||
+		!lines["p.requests.count:1|c|#env:prod,route:/b"] ||
+		!lines["p.requests.count:1|c|#env:prod"] {
+		t.Fatal(lines)
+	}
+	dropped := self.Get("statsd.tag-cardinality-dropped").(Counter)
+	if count := dropped.Count(); 1 != count {
+		t.Fatal(count)
+	}
+	ctx := WithTags(context.Background(), map[string]string{"route": "/d"})
+	GetOrRegisterTagged(ctx, r, "requests", NewCounter).(Counter).Inc(1)
+	GetOrRegisterTagged(WithTags(context.Background(), map[string]string{"route": "/a"}), r, "requests", NewCounter).(Counter).Inc(1)
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+	lines = statsdLines(server.Packets())
+	if !lines["p.requests.count:2|c|#env:prod,route:/a"] || !lines["p.requests.count:1|c|#env:prod"] || lines["p.requests.count:1|c|#env:prod,route:/d"] {
+		t.Fatal(lines)
+	}
+
+	// Both /c and /d are sent without their tags.
+	if count := dropped.Count(); 3 != count {
+		t.Fatal(count)
+	}
+}
+
+func TestStatsdMaxTagCardinalityPerMetric(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r, self := NewRegistry(), NewRegistry()
+	for _, route := range []string{"/a", "/b"} {
+		ctx := WithTags(context.Background(), map[string]string{"route": route})
+		GetOrRegisterTagged(ctx, r, "requests", NewCounter).(Counter).Inc(1)
+	}
+	for _, route := range []string{"/b", "/c"} {
+		ctx := WithTags(context.Background(), map[string]string{"route": route})
+		GetOrRegisterTagged(ctx, r, "responses", NewCounter).(Counter).Inc(1)
+	}
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:              server.Addr(),
+		Registry:          r,
+		FlushInterval:     time.Second,
+		Prefix:            "p",
+		TagFormat:         TagFormatDatadog,
+		MaxTagCardinality: 2,
+		SortedOutput:      true,
+		SelfRegistry:      self,
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+
+	// Each metric is capped at two combinations of its own, so responses'
+	// /c isn't dropped for the combinations requests has already used.
+	lines := statsdLines(server.Packets())
+	if 4 != len(lines) ||
+		!lines["p.requests.count:1|c|#route:/a"] ||
+		!lines["p.requests.count:1|c|#route:/b"] ||
+		!lines["p.responses.count:1|c|#route:/b"] ||
+		!lines["p.responses.count:1|c|#route:/c"] {
+		t.Fatal(lines)
+	}
+	if count := self.Get("statsd.tag-cardinality-dropped").(Counter).Count(); 0 != count {
+		t.Fatal(count)
+	}
+}
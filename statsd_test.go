@@ -1,9 +1,92 @@
 package metrics
 
 import (
-  "time"
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
 )
 
+// discardConn is a net.Conn which discards everything written to it.
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Close() error { return nil }
+
+func (discardConn) Write(b []byte) (int, error) { return len(b), nil }
+
+// statsdTestConn is a net.Conn which records every packet written to it.
+type statsdTestConn struct {
+	net.Conn
+	mutex   sync.Mutex
+	packets []string
+}
+
+func (c *statsdTestConn) Close() error { return nil }
+
+func (c *statsdTestConn) Packets() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.packets...)
+}
+
+func (c *statsdTestConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.packets = append(c.packets, string(b))
+	return len(b), nil
+}
+
+// statsdTestServer is a UDP statsd server which records every packet
+// received.
+type statsdTestServer struct {
+	conn net.PacketConn
+}
+
+func newStatsdTestServer(t *testing.T) *statsdTestServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	return &statsdTestServer{conn}
+}
+
+func (s *statsdTestServer) Addr() string { return s.conn.LocalAddr().String() }
+
+func (s *statsdTestServer) Close() error { return s.conn.Close() }
+
+// Packets returns the packets received until none arrive for 100ms.
+func (s *statsdTestServer) Packets() []string {
+	var packets []string
+	buf := make([]byte, 65536)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := s.conn.ReadFrom(buf)
+		if nil != err {
+			return packets
+		}
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+// statsdLines returns the set of metric lines found in the given packets.
+func statsdLines(packets []string) map[string]bool {
+	lines := make(map[string]bool)
+	for _, packet := range packets {
+		for _, line := range strings.Split(packet, "\n") {
+			lines[line] = true
+		}
+	}
+	return lines
+}
+
 func ExampleStatsd() {
   go Statsd(DefaultRegistry, 1*time.Second, "some.prefix", "localhost:8125")
 }
@@ -16,3 +99,2825 @@ func ExampleStatsdWithConfig() {
     DurationUnit:  time.Millisecond,
   })
 }
+
+func TestStatsdClientDelimiter(t *testing.T) {
+	conn := &statsdTestConn{}
+	c := newClient(conn, 0)
+	c.Increment("foo", 1, 1)
+	c.GaugeInt64("bar", 2, 1)
+	c.Flush()
+	if packets := conn.Packets(); 1 != len(packets) || "foo:1|c\nbar:2|g" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+
+	conn = &statsdTestConn{}
+	c = newClient(conn, 0)
+	c.setDelimiter(0)
+	c.Increment("foo", 1, 1)
+	c.GaugeInt64("bar", 2, 1)
+	c.Flush()
+	if packets := conn.Packets(); 1 != len(packets) || "foo:1|c\x00bar:2|g" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestStatsdClientDelimiterFitsPacket(t *testing.T) {
+	conn := &statsdTestConn{}
+	c := newClient(conn, 14)
+	c.Increment("foo", 1, 1) // 7 bytes
+	c.Increment("bar", 1, 1) // 7 bytes plus the delimiter overflows 14
+	c.Flush()
+	packets := conn.Packets()
+	if 2 != len(packets) || "foo:1|c" != packets[0] || "bar:1|c" != packets[1] {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestStatsdMetricDelimiter(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredCounter("foo", r).Inc(1)
+	NewRegisteredGauge("bar", r).Update(2)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:            server.Addr(),
+		Registry:        r,
+		FlushInterval:   time.Second,
+		Prefix:          "p",
+		MetricDelimiter: ';',
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	packets := server.Packets()
+	if 1 != len(packets) {
+		t.Fatalf("%q", packets)
+	}
+	if "p.foo.count:1|c;p.bar.value:2|g" != packets[0] && "p.bar.value:2|g;p.foo.count:1|c" != packets[0] {
+		t.Fatalf("%q", packets[0])
+	}
+}
+
+func TestStatsdMetricDelimiterInName(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredGauge("a,b", r).Update(1)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:            server.Addr(),
+		Registry:        r,
+		FlushInterval:   time.Second,
+		Prefix:          "p",
+		MetricDelimiter: ',',
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	if packets := server.Packets(); 1 != len(packets) || "p.a_b.value:1|g" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestStatsdRegistries(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r1, r2 := NewRegistry(), NewRegistry()
+	NewRegisteredGauge("foo", r1).Update(1)
+	NewRegisteredGauge("foo", r2).Update(2)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:           server.Addr(),
+		Registries:     []Registry{r1, r2},
+		FlushInterval:  time.Second,
+		Prefix:         "p",
+		RegistryLabels: []string{"", "two"},
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	packets := server.Packets()
+	if 1 != len(packets) || "p.foo.value:1|g\np.two.foo.value:2|g" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestStatsdPercentileNearestRank(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	tm := NewCustomTimer(NewHistogram(NewUniformSample(100)), NewMeter())
+	r.Register("foo", tm)
+	for i := 1; i <= 20; i++ {
+		tm.Update(time.Duration(i))
+	}
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:             server.Addr(),
+		Registry:         r,
+		FlushInterval:    time.Second,
+		DurationUnit:     time.Nanosecond,
+		Prefix:           "p",
+		PercentileMethod: PercentileNearestRank,
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	lines := statsdLines(server.Packets())
+	if !lines["p.foo.95-percentile:19|g"] {
+		t.Fatal(lines)
+	}
+}
+
+func TestStatsdEmptyNames(t *testing.T) {
+	for placeholder, expected := range map[string][]string{
+		"":        {"p.foo.count:1|c"},
+		"unnamed": {"p.foo.count:1|c", "p.unnamed.count:2|c"},
+	} {
+		server := newStatsdTestServer(t)
+		r, self := NewRegistry(), NewRegistry()
+		NewRegisteredCounter("", r).Inc(2)
+		NewRegisteredCounter("foo", r).Inc(1)
+		if err := NewStatsdReporter(StatsdConfig{
+			Addr:                 server.Addr(),
+			Registry:             r,
+			FlushInterval:        time.Second,
+			Prefix:               "p",
+			SelfRegistry:         self,
+			EmptyNamePlaceholder: placeholder,
+		}).flush(); nil != err {
+			t.Fatal(err)
+		}
+		lines := statsdLines(server.Packets())
+		server.Close()
+		if len(expected) != len(lines) {
+			t.Errorf("placeholder %q: %v", placeholder, lines)
+		}
+		for _, line := range expected {
+			if !lines[line] {
+				t.Errorf("placeholder %q: %s missing from %v", placeholder, line, lines)
+			}
+		}
+		skipped := int64(0)
+		if "" == placeholder {
+			skipped = 1
+		}
+		if count := self.Get("statsd.empty-names").(Counter).Count(); skipped != count {
+			t.Errorf("placeholder %q: %d skipped", placeholder, count)
+		}
+	}
+}
+
+func TestStatsdSortedOutput(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredTimer("a", r).Update(time.Millisecond)
+	NewRegisteredGauge("b", r).Update(1)
+	NewRegisteredCounter("c", r).Inc(1)
+	NewRegisteredGaugeFloat64("d", r).Update(1.5)
+	NewRegisteredCounter("e", r).Inc(1)
+	NewRegisteredTimer("f", r).Update(time.Millisecond)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		SortedOutput:  true,
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, packet := range server.Packets() {
+		for _, line := range strings.Split(packet, "\n") {
+			name := strings.SplitN(line, ".", 3)[1]
+			if 0 == len(names) || names[len(names)-1] != name {
+				names = append(names, name)
+			}
+		}
+	}
+	if expected := []string{"c", "e", "b", "d", "a", "f"}; fmt.Sprint(expected) != fmt.Sprint(names) {
+		t.Fatal(names)
+	}
+}
+
+func TestStatsdMaxMetricsPerFlush(t *testing.T) {
+	for _, test := range []struct {
+		priority func(string) int
+		flushes  int
+		always   string
+	}{
+		{nil, 3, ""},
+		{func(name string) int {
+			if "a" == name {
+				return 1
+			}
+			return 0
+		}, 5, "p.a.value:1|g"},
+	} {
+		server := newStatsdTestServer(t)
+		r := NewRegistry()
+		for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+			NewRegisteredGauge(name, r).Update(1)
+		}
+		reporter := NewStatsdReporter(StatsdConfig{
+			Addr:               server.Addr(),
+			Registry:           r,
+			FlushInterval:      time.Second,
+			Prefix:             "p",
+			MaxMetricsPerFlush: 2,
+			MetricPriority:     test.priority,
+		})
+		sent := make(map[string]int)
+		for i := 0; i < test.flushes; i++ {
+			if err := reporter.flush(); nil != err {
+				t.Fatal(err)
+			}
+			lines := statsdLines(server.Packets())
+			if 2 != len(lines) || "" != test.always && !lines[test.always] {
+				t.Fatal(lines)
+			}
+			for line := range lines {
+				sent[line]++
+			}
+		}
+		server.Close()
+		if 6 != len(sent) {
+			t.Fatal(sent)
+		}
+		for line, n := range sent {
+			if line != test.always && 1 != n {
+				t.Error(line, n)
+			}
+		}
+	}
+}
+
+func TestStatsdFlushDeadline(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	for i := 0; i < 10000; i++ {
+		tm := NewTimer()
+		tm.Update(time.Duration(i))
+		r.Register(fmt.Sprintf("timer%d", i), tm)
+	}
+	c := StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		FlushDeadline: time.Millisecond,
+	}
+	start := time.Now()
+	err := NewStatsdReporter(c).flush()
+	if elapsed := time.Since(start); 100*time.Millisecond < elapsed {
+		t.Errorf("flush took %v", elapsed)
+	}
+	if nil == err || !strings.Contains(err.Error(), "skipped") {
+		t.Fatal(err)
+	}
+}
+
+func TestStatsdDedupPercentiles(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredTimer("foo", r).Update(47)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:             server.Addr(),
+		Registry:         r,
+		FlushInterval:    time.Second,
+		DurationUnit:     time.Nanosecond,
+		Prefix:           "p",
+		DedupPercentiles: true,
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	lines := statsdLines(server.Packets())
+	for _, line := range []string{
+		"p.foo.min:47|g",
+		"p.foo.max:47|g",
+		"p.foo.mean:47|g",
+		"p.foo.50-percentile:47|g",
+	} {
+		if !lines[line] {
+			t.Errorf("%s missing from %v", line, lines)
+		}
+	}
+	for line := range lines {
+		if strings.Contains(line, "-percentile") && !strings.HasPrefix(line, "p.foo.50-percentile:") {
+			t.Errorf("%s not deduplicated", line)
+		}
+	}
+}
+
+func TestStatsdWithConfigClock(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	g := NewRegisteredGauge("foo", r)
+	clock := newFakeClock()
+	go StatsdWithConfig(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Clock:         clock,
+	})
+	<-clock.created
+	if packets := server.Packets(); 0 != len(packets) {
+		t.Fatalf("%q", packets)
+	}
+	for i := int64(1); i <= 2; i++ {
+		g.Update(i)
+		clock.Advance(time.Second)
+		if packets := server.Packets(); 1 != len(packets) || fmt.Sprintf("foo.value:%d|g", i) != packets[0] {
+			t.Fatalf("%q", packets)
+		}
+	}
+}
+
+func TestStatsdMaxBytesPerSecond(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r, self := NewRegistry(), NewRegistry()
+	for i := 0; i < 5; i++ {
+		NewRegisteredGauge(fmt.Sprintf("g%d", i), r).Update(1)
+	}
+	clock := newFakeClock()
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:              server.Addr(),
+		Registry:          r,
+		FlushInterval:     time.Second,
+		Prefix:            "p",
+		Clock:             clock,
+		MaxBytesPerSecond: 20, // Room for one 15-byte metric per second.
+		SelfRegistry:      self,
+	})
+	dropped := GetOrRegisterCounter("statsd.dropped", self)
+	for i := int64(1); i <= 2; i++ {
+		if err := reporter.flush(); nil != err {
+			t.Fatal(err)
+		}
+		if lines := statsdLines(server.Packets()); 1 != len(lines) {
+			t.Fatal(lines)
+		}
+		if count := dropped.Count(); 4*i != count {
+			t.Fatalf("statsd.dropped: %d != %d", 4*i, count)
+		}
+		clock.Advance(time.Second)
+	}
+}
+
+func TestStatsdSpillLines(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r, self := NewRegistry(), NewRegistry()
+	for i := 0; i < 3; i++ {
+		NewRegisteredGauge(fmt.Sprintf("g%d", i), r).Update(1)
+	}
+	clock := newFakeClock()
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:              server.Addr(),
+		Registry:          r,
+		FlushInterval:     time.Second,
+		Prefix:            "p",
+		Clock:             clock,
+		MaxBytesPerSecond: 20, // Room for one 14-byte metric per second.
+		SpillLines:        1,
+		SortedOutput:      true,
+		SelfRegistry:      self,
+	})
+	dropped := GetOrRegisterCounter("statsd.dropped", self)
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+	if packets := server.Packets(); 1 != len(packets) || "p.g0.value:1|g" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+	if count := dropped.Count(); 1 != count {
+		t.Fatalf("statsd.dropped: 1 != %d", count)
+	}
+	for i := 0; i < 3; i++ {
+		r.Unregister(fmt.Sprintf("g%d", i))
+	}
+	clock.Advance(time.Second)
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+	if packets := server.Packets(); 1 != len(packets) || "p.g2.value:1|g" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+	if count := dropped.Count(); 1 != count {
+		t.Fatalf("statsd.dropped: 1 != %d", count)
+	}
+}
+
+// clockGauge is a Gauge which advances a fake clock whenever it's read.
+type clockGauge struct {
+	Gauge
+	clock *fakeClock
+	d     time.Duration
+}
+
+func (g clockGauge) Value() int64 {
+	g.clock.Advance(g.d)
+	return g.Gauge.Value()
+}
+
+func TestStatsdSpillLinesDeadline(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r, self := NewRegistry(), NewRegistry()
+	clock := newFakeClock()
+	r.Register("g0", clockGauge{NewGauge(), clock, time.Second})
+	for i := 1; i < 4; i++ {
+		NewRegisteredGauge(fmt.Sprintf("g%d", i), r).Update(1)
+	}
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		FlushDeadline: time.Millisecond,
+		Prefix:        "p",
+		Clock:         clock,
+		SpillLines:    2,
+		SortedOutput:  true,
+		SelfRegistry:  self,
+	})
+	if err := reporter.flush(); nil == err || !strings.Contains(err.Error(), "spilled 3 metrics") {
+		t.Fatal(err)
+	}
+	if packets := server.Packets(); 1 != len(packets) || "p.g0.value:0|g" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+	if count := GetOrRegisterCounter("statsd.dropped", self).Count(); 1 != count {
+		t.Fatalf("statsd.dropped: 1 != %d", count)
+	}
+	for i := 0; i < 4; i++ {
+		r.Unregister(fmt.Sprintf("g%d", i))
+	}
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+	if packets := server.Packets(); 1 != len(packets) || "p.g2.value:1|g\np.g3.value:1|g" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+}
+
+// backpressureConn is a net.Conn whose writes time out while it's full.
+type backpressureConn struct {
+	statsdTestConn
+	full bool
+}
+
+func (c *backpressureConn) Write(b []byte) (int, error) {
+	if c.full {
+		return 0, &net.OpError{Op: "write", Net: "udp", Err: timeoutError{}}
+	}
+	return c.statsdTestConn.Write(b)
+}
+
+// timeoutError is a net.Error which timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestStatsdSpillLinesBackpressure(t *testing.T) {
+	r := NewRegistry()
+	NewRegisteredGauge("foo", r).Update(1)
+	conn := &backpressureConn{full: true}
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:          "statsd:8125",
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		SpillLines:    10,
+		Dialer: func(network, addr string) (net.Conn, error) {
+			return conn, nil
+		},
+	})
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+	if packets := conn.Packets(); 0 != len(packets) {
+		t.Fatalf("%q", packets)
+	}
+	conn.full = false
+	r.Unregister("foo")
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+	if packets := conn.Packets(); 1 != len(packets) || "p.foo.value:1|g" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestStatsdChangedOnly(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	m := NewRegisteredMeter("foo", r)
+	m.Mark(1)
+	tm := NewRegisteredTimer("baz", r)
+	tm.Update(time.Millisecond)
+	h := NewRegisteredHistogram("qux", r, NewUniformSample(100))
+	h.Update(1)
+	NewRegisteredGauge("bar", r).Update(1)
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:             server.Addr(),
+		Registry:         r,
+		FlushInterval:    time.Second,
+		Prefix:           "p",
+		ChangedOnly:      true,
+		ReportHistograms: true,
+	})
+	for i, expected := range []bool{true, false, false, true} {
+		switch i {
+		case 2:
+			// Idle meters' rates decay on every tick but their counts don't.
+			m.(*StandardMeter).tick()
+		case 3:
+			m.Mark(1)
+			tm.Update(time.Millisecond)
+			h.Update(2)
+		}
+		if err := reporter.flush(); nil != err {
+			t.Fatal(err)
+		}
+		lines := statsdLines(server.Packets())
+		if sent := lines[fmt.Sprintf("p.foo.count:%d|g", m.Count())]; expected != sent {
+			t.Errorf("flush %d: meter sent %v, expected %v: %v", i, sent, expected, lines)
+		}
+		if sent := lines[fmt.Sprintf("p.baz.count:%d|g", tm.Count())]; expected != sent {
+			t.Errorf("flush %d: timer sent %v, expected %v: %v", i, sent, expected, lines)
+		}
+		if sent := lines[fmt.Sprintf("p.qux.count:%d|g", h.Count())]; expected != sent {
+			t.Errorf("flush %d: histogram sent %v, expected %v: %v", i, sent, expected, lines)
+		}
+		if !lines["p.bar.value:1|g"] {
+			t.Errorf("flush %d: gauge not sent: %v", i, lines)
+		}
+	}
+}
+
+func TestStatsdChangedOnlyReload(t *testing.T) {
+	r := NewRegistry()
+	NewRegisteredMeter("foo", r).Mark(1)
+	reporter := NewStatsdReporter(StatsdConfig{
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		Dialer: func(network, addr string) (net.Conn, error) {
+			return discardConn{}, nil
+		},
+	})
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			reporter.mutex.Lock()
+			reporter.c.ChangedOnly = !reporter.c.ChangedOnly
+			reporter.mutex.Unlock()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if err := reporter.flush(); nil != err {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	<-done
+}
+
+func TestStatsdCounterDelta(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	for deltas, expected := range map[bool][]int64{false: {3, 7}, true: {3, 4}} {
+		r := NewRegistry()
+		c := NewRegisteredCounter("foo", r)
+		reporter := NewStatsdReporter(StatsdConfig{
+			Addr:          server.Addr(),
+			Registry:      r,
+			FlushInterval: time.Second,
+			Prefix:        "p",
+			CounterDeltas: deltas,
+		})
+		for i, inc := range []int64{3, 4} {
+			c.Inc(inc)
+			if err := reporter.flush(); nil != err {
+				t.Fatal(err)
+			}
+			if packets := server.Packets(); 1 != len(packets) || fmt.Sprintf("p.foo.count:%d|c", expected[i]) != packets[0] {
+				t.Fatalf("deltas %v: %q", deltas, packets)
+			}
+		}
+	}
+}
+
+func TestStatsdCounterDeltaAfterTotals(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	c := NewRegisteredCounter("foo", r)
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+	})
+
+	// Counts sent as totals carry over to the first delta once deltas are
+	// switched on.
+	for i, step := range []struct {
+		inc, expected int64
+		deltas        bool
+	}{
+		{3, 3, false},
+		{0, 3, false},
+		{4, 7, false},
+		{2, 2, true},
+	} {
+		reporter.mutex.Lock()
+		reporter.c.CounterDeltas = step.deltas
+		reporter.mutex.Unlock()
+		c.Inc(step.inc)
+		if err := reporter.flush(); nil != err {
+			t.Fatal(err)
+		}
+		if packets := server.Packets(); 1 != len(packets) || fmt.Sprintf("p.foo.count:%d|c", step.expected) != packets[0] {
+			t.Fatalf("flush %d: %q", i, packets)
+		}
+	}
+}
+
+func TestStatsdTimerCountAsCounter(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	for _, asCounter := range []bool{false, true} {
+		r := NewRegistry()
+		tm := NewRegisteredTimer("foo", r)
+		reporter := NewStatsdReporter(StatsdConfig{
+			Addr:                server.Addr(),
+			Registry:            r,
+			FlushInterval:       time.Second,
+			Prefix:              "p",
+			TimerCountAsCounter: asCounter,
+		})
+		for i := 0; i < 2; i++ {
+			tm.Update(time.Millisecond)
+			if err := reporter.flush(); nil != err {
+				t.Fatal(err)
+			}
+			line := fmt.Sprintf("p.foo.count:%d|g", tm.Count())
+			if asCounter {
+				line = "p.foo.count:1|c"
+			}
+			if lines := statsdLines(server.Packets()); !lines[line] {
+				t.Fatalf("%s missing from %v", line, lines)
+			}
+		}
+	}
+}
+
+func TestStatsdRunHealthchecksBeforeFlush(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	checks := 0
+	r.Register("foo", NewHealthcheck(func(h Healthcheck) {
+		checks++
+		if 0 == checks%2 {
+			h.Unhealthy(errors.New("even"))
+		} else {
+			h.Healthy()
+		}
+	}))
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:                       server.Addr(),
+		Registry:                   r,
+		FlushInterval:              time.Second,
+		Prefix:                     "p",
+		RunHealthchecksBeforeFlush: true,
+	})
+	for i, line := range []string{"p.foo.healthy:1|g", "p.foo.healthy:0|g"} {
+		if err := reporter.flush(); nil != err {
+			t.Fatal(err)
+		}
+		if i+1 != checks {
+			t.Fatalf("%d checks after %d flushes", checks, i+1)
+		}
+		if packets := server.Packets(); 1 != len(packets) || line != packets[0] {
+			t.Fatalf("%q", packets)
+		}
+	}
+}
+
+func TestStatsdHealthcheckErrorTags(t *testing.T) {
+	datadog, plain := newStatsdTestServer(t), newStatsdTestServer(t)
+	defer datadog.Close()
+	defer plain.Close()
+	r := NewRegistry()
+	r.Register("foo", NewHealthcheck(func(h Healthcheck) {
+		h.Unhealthy(errors.New("disk full"))
+	}))
+	r.RunHealthchecks()
+	if err := NewStatsdReporter(StatsdConfig{
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		Tags:          map[string]string{"env": "prod"},
+		Targets: []StatsdTarget{
+			{Addr: datadog.Addr(), TagFormat: TagFormatDatadog},
+			{Addr: plain.Addr()},
+		},
+		HealthcheckErrorTags: true,
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	if lines := statsdLines(datadog.Packets()); 1 != len(lines) || !lines["p.foo.healthy:0|g|#env:prod,error:disk_full"] {
+		t.Fatal(lines)
+	}
+	if lines := statsdLines(plain.Packets()); 1 != len(lines) || !lines["p.foo.healthy:0|g"] {
+		t.Fatal(lines)
+	}
+}
+
+func TestStatsdEmitSequence(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredGauge("foo", r).Update(1)
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:           server.Addr(),
+		Registry:       r,
+		FlushInterval:  time.Second,
+		Prefix:         "p",
+		EmitSequence:   true,
+		SequenceMetric: "seq",
+	})
+	for i := 1; i <= 3; i++ {
+		if err := reporter.flush(); nil != err {
+			t.Fatal(err)
+		}
+		packets := server.Packets()
+		if 1 != len(packets) || !strings.HasSuffix(packets[0], fmt.Sprintf("\np.seq:%d|g", i)) {
+			t.Fatalf("%q", packets)
+		}
+	}
+}
+
+func TestStatsdDurationUnitFunc(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredTimer("fast", r).Update(1500 * time.Microsecond)
+	NewRegisteredTimer("slow", r).Update(3 * time.Second)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		DurationUnit:  time.Millisecond,
+		Prefix:        "p",
+		DurationUnitFunc: func(name string) time.Duration {
+			if "slow" == name {
+				return time.Second
+			}
+			return 0
+		},
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	lines := statsdLines(server.Packets())
+	for _, line := range []string{
+		"p.fast.max:1|g",
+		"p.fast.mean:1.5|g",
+		"p.slow.max:3|g",
+		"p.slow.mean:3|g",
+	} {
+		if !lines[line] {
+			t.Errorf("%s missing from %v", line, lines)
+		}
+	}
+}
+
+func TestStatsdDurationUnitSuffix(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredTimer("latency", r).Update(1500 * time.Microsecond)
+	NewRegisteredTimer("gc", r).Update(47 * time.Microsecond)
+	NewRegisteredTimer("odd", r).Update(3 * time.Millisecond)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:               server.Addr(),
+		Registry:           r,
+		FlushInterval:      time.Second,
+		DurationUnit:       time.Millisecond,
+		DurationUnitSuffix: true,
+		Percentiles:        []float64{0.5},
+		Prefix:             "p",
+		DurationUnitFunc: func(name string) time.Duration {
+			switch name {
+			case "gc":
+				return time.Microsecond
+			case "odd":
+				return 1500 * time.Microsecond
+			}
+			return 0
+		},
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	lines := statsdLines(server.Packets())
+	for _, line := range []string{
+		"p.latency.count:1|g",
+		"p.latency.max.ms:1|g",
+		"p.latency.mean.ms:1.5|g",
+		"p.latency.50-percentile.ms:1.5|g",
+		"p.gc.count:1|g",
+		"p.gc.max.us:47|g",
+		"p.gc.mean.us:47|g",
+		"p.gc.50-percentile.us:47|g",
+		"p.odd.max.1_5ms:2|g",
+		"p.odd.mean.1_5ms:2|g",
+	} {
+		if !lines[line] {
+			t.Errorf("%s missing from %v", line, lines)
+		}
+	}
+}
+
+func TestStatsdDurationUnit(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredTimer("foo", r).Update(1500 * time.Microsecond)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		DurationUnit:  time.Millisecond,
+		Percentiles:   []float64{0.5},
+		Prefix:        "p",
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	lines := statsdLines(server.Packets())
+	for _, line := range []string{
+		"p.foo.max:1|g",
+		"p.foo.mean:1.5|g",
+		"p.foo.50-percentile:1.5|g",
+	} {
+		if !lines[line] {
+			t.Errorf("%s missing from %v", line, lines)
+		}
+	}
+}
+
+func TestStatsdDefaultDurationUnit(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredTimer("foo", r).Update(47 * time.Microsecond)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	if lines := statsdLines(server.Packets()); !lines["p.foo.max:47000|g"] {
+		t.Fatal(lines)
+	}
+}
+
+func TestStatsdUseTimingType(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	timer := NewRegisteredTimer("foo", r)
+	timer.Update(3 * time.Millisecond)
+	timer.Update(47 * time.Millisecond)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		DurationUnit:  time.Millisecond,
+		Prefix:        "p",
+		UseTimingType: true,
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	lines := statsdLines(server.Packets())
+	for _, line := range []string{
+		"p.foo.min:3|ms",
+		"p.foo.max:47|ms",
+		"p.foo.mean:25|g",
+	} {
+		if !lines[line] {
+			t.Errorf("%s missing from %v", line, lines)
+		}
+	}
+}
+
+func TestStatsdUseMeterType(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	counter := NewRegisteredCounter("foo", r)
+	counter.Inc(5)
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		CounterDeltas: true,
+		UseMeterType:  true,
+	})
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+	counter.Inc(2)
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+	lines := statsdLines(server.Packets())
+	if 2 != len(lines) || !lines["p.foo.count:5|m"] || !lines["p.foo.count:2|m"] {
+		t.Fatal(lines)
+	}
+}
+
+func TestStatsdRoundPercentiles(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredTimer("foo", r).Update(1234700 * time.Microsecond)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:             server.Addr(),
+		Registry:         r,
+		FlushInterval:    time.Second,
+		DurationUnit:     time.Millisecond,
+		Prefix:           "p",
+		Percentiles:      []float64{0.95},
+		RoundPercentiles: true,
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	lines := statsdLines(server.Packets())
+	if !lines["p.foo.95-percentile:1235|g"] || !lines["p.foo.mean:1234.7|g"] {
+		t.Fatal(lines)
+	}
+}
+
+func TestStatsdHistogramPercentiles(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	h := NewRegisteredHistogram("size", r, NewUniformSample(100))
+	timer := NewRegisteredTimer("latency", r)
+	for i := int64(1); i <= 100; i++ {
+		h.Update(i)
+		timer.Update(time.Duration(i))
+	}
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:                 server.Addr(),
+		Registry:             r,
+		FlushInterval:        time.Second,
+		Prefix:               "p",
+		Percentiles:          []float64{0.5},
+		ReportHistograms:     true,
+		HistogramPercentiles: []float64{0.9},
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	lines := statsdLines(server.Packets())
+	for _, line := range []string{
+		"p.size.count:100|g",
+		"p.size.max:100|g",
+		"p.size.90-percentile:90.9|g",
+		"p.latency.50-percentile:50.5|g",
+	} {
+		if !lines[line] {
+			t.Errorf("%s missing from %v", line, lines)
+		}
+	}
+	for line := range lines {
+		if strings.HasPrefix(line, "p.size.50-") || strings.HasPrefix(line, "p.latency.90-") {
+			t.Errorf("unexpected %s", line)
+		}
+	}
+}
+
+func TestStatsdHistogramsSkipped(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredHistogram("size", r, NewUniformSample(100)).Update(1)
+	NewRegisteredGauge("foo", r).Update(1)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	if packets := server.Packets(); 1 != len(packets) || "p.foo.value:1|g" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestStatsdReportSumVariance(t *testing.T) {
+	r := NewRegistry()
+	h := NewRegisteredHistogram("size", r, NewUniformSample(100))
+	for i := int64(1); i <= 4; i++ {
+		h.Update(i)
+	}
+	flush := func(report bool) map[string]bool {
+		server := newStatsdTestServer(t)
+		defer server.Close()
+		if err := NewStatsdReporter(StatsdConfig{
+			Addr:             server.Addr(),
+			Registry:         r,
+			FlushInterval:    time.Second,
+			Prefix:           "p",
+			ReportHistograms: true,
+			ReportSum:        report,
+			ReportVariance:   report,
+		}).flush(); nil != err {
+			t.Fatal(err)
+		}
+		return statsdLines(server.Packets())
+	}
+	without, with := flush(false), flush(true)
+	if len(without)+2 != len(with) || !with["p.size.sum:10|g"] || !with["p.size.variance:1.25|g"] {
+		t.Fatal(with)
+	}
+	for line := range without {
+		if !with[line] {
+			t.Errorf("%s missing from %v", line, with)
+		}
+	}
+}
+
+func TestStatsdGaugeRateMetrics(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	bytes := NewRegisteredGauge("bytes", r)
+	bytes.Update(5000)
+	NewRegisteredGauge("other", r).Update(1)
+	clock := newFakeClock()
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:             server.Addr(),
+		Registry:         r,
+		FlushInterval:    time.Second,
+		Prefix:           "p",
+		Clock:            clock,
+		GaugeRateMetrics: []string{"bytes"},
+	})
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+	if lines := statsdLines(server.Packets()); 2 != len(lines) {
+		t.Fatal(lines)
+	}
+	bytes.Update(6000)
+	clock.Advance(2 * time.Second)
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+	lines := statsdLines(server.Packets())
+	if 3 != len(lines) || !lines["p.bytes.value:6000|g"] || !lines["p.bytes.rate:500|g"] {
+		t.Fatal(lines)
+	}
+}
+
+func TestStatsdCompactPercentiles(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	timer := NewRegisteredTimer("latency", r)
+	for i := int64(1); i <= 100; i++ {
+		timer.Update(time.Duration(i) * time.Millisecond)
+	}
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:               server.Addr(),
+		Registry:           r,
+		FlushInterval:      time.Second,
+		DurationUnit:       time.Millisecond,
+		Prefix:             "p",
+		Percentiles:        []float64{0.99, 0.5, 0.75},
+		CompactPercentiles: true,
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	lines := statsdLines(server.Packets())
+	if !lines["p.latency.percentiles:99.99:50.5:75.75|g"] {
+		t.Fatal(lines)
+	}
+	for line := range lines {
+		if strings.Contains(line, "-percentile") {
+			t.Errorf("unexpected %s", line)
+		}
+	}
+}
+
+// nilRegistry is a Registry which also yields an untyped nil metric.
+type nilRegistry struct {
+	Registry
+}
+
+func (r nilRegistry) Each(f func(string, interface{})) {
+	r.Registry.Each(f)
+	f("untyped", nil)
+}
+
+func TestStatsdNilMetrics(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r, self := NewRegistry(), NewRegistry()
+	r.Register("timer", (*StandardTimer)(nil))
+	r.Register("counter", (*StandardCounter)(nil))
+	NewRegisteredCounter("foo", r).Inc(1)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      nilRegistry{r},
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		SelfRegistry:  self,
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	if lines := statsdLines(server.Packets()); 1 != len(lines) || !lines["p.foo.count:1|c"] {
+		t.Fatal(lines)
+	}
+	if count := self.Get("statsd.nil-metrics").(Counter).Count(); 3 != count {
+		t.Fatal(count)
+	}
+}
+
+func TestStatsdEmitFlushCount(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:           server.Addr(),
+		Registry:       NewRegistry(),
+		FlushInterval:  time.Second,
+		Prefix:         "p",
+		EmitFlushCount: true,
+	})
+	for i := 0; i < 2; i++ {
+		if err := reporter.flush(); nil != err {
+			t.Fatal(err)
+		}
+		if packets := server.Packets(); 1 != len(packets) || "p.statsd.flush_count:1|c" != packets[0] {
+			t.Fatalf("%q", packets)
+		}
+	}
+}
+
+func TestStatsdEmitSecondsSinceLastFlush(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	clock := newFakeClock()
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:                      server.Addr(),
+		Registry:                  NewRegistry(),
+		FlushInterval:             time.Second,
+		Prefix:                    "p",
+		Clock:                     clock,
+		EmitSecondsSinceLastFlush: true,
+	})
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+	if packets := server.Packets(); 0 != len(packets) {
+		t.Fatalf("%q", packets)
+	}
+	clock.Advance(90 * time.Second)
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+	if packets := server.Packets(); 1 != len(packets) || "p.statsd.seconds_since_last_flush:90|g" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestStatsdCollisions(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r1, r2 := NewRegistry(), NewRegistry()
+	NewRegisteredTimer("foo", r1).Update(time.Millisecond)
+	NewRegisteredCounter("foo", r2).Inc(1)
+	err := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registries:    []Registry{r1, r2},
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		Collisions:    CollisionError,
+	}).flush()
+	if !errors.Is(err, MetricNameCollision("p.foo.count")) {
+		t.Fatal(err)
+	}
+	count := 0
+	for line := range statsdLines(server.Packets()) {
+		if strings.HasPrefix(line, "p.foo.count:") {
+			count++
+		}
+	}
+	if 1 != count {
+		t.Fatalf("p.foo.count sent %d times", count)
+	}
+}
+
+func TestStatsdGaugeConflicts(t *testing.T) {
+	for policy, expected := range map[GaugeConflictPolicy][]string{
+		GaugeConflictBoth:        {"p.bar.value:3|g", "p.foo.value:1|g", "p.foo.value:2.5|g"},
+		GaugeConflictPreferFloat: {"p.bar.value:3|g", "p.foo.value:2.5|g"},
+		GaugeConflictPreferInt:   {"p.bar.value:3|g", "p.foo.value:1|g"},
+		GaugeConflictError:       {"p.bar.value:3|g"},
+	} {
+		server := newStatsdTestServer(t)
+		r1, r2 := NewRegistry(), NewRegistry()
+		NewRegisteredGauge("foo", r1).Update(1)
+		NewRegisteredGaugeFloat64("foo", r2).Update(2.5)
+		NewRegisteredGauge("bar", r2).Update(3)
+		err := NewStatsdReporter(StatsdConfig{
+			Addr:           server.Addr(),
+			Registries:     []Registry{r1, r2},
+			FlushInterval:  time.Second,
+			Prefix:         "p",
+			GaugeConflicts: policy,
+		}).flush()
+		if GaugeConflictError == policy {
+			if !errors.Is(err, MetricNameCollision("p.foo.value")) {
+				t.Errorf("policy %d: %v", policy, err)
+			}
+		} else if nil != err {
+			t.Errorf("policy %d: %v", policy, err)
+		}
+		lines := statsdLines(server.Packets())
+		server.Close()
+		if len(expected) != len(lines) {
+			t.Errorf("policy %d: %v", policy, lines)
+		}
+		for _, line := range expected {
+			if !lines[line] {
+				t.Errorf("policy %d: %s missing from %v", policy, line, lines)
+			}
+		}
+	}
+}
+
+func TestStatsdCollisionsIgnored(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r1, r2 := NewRegistry(), NewRegistry()
+	NewRegisteredTimer("foo", r1).Update(time.Millisecond)
+	NewRegisteredCounter("foo", r2).Inc(1)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registries:    []Registry{r1, r2},
+		FlushInterval: time.Second,
+		Prefix:        "p",
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	if lines := statsdLines(server.Packets()); !lines["p.foo.count:1|g"] || !lines["p.foo.count:1|c"] {
+		t.Fatal(lines)
+	}
+}
+
+func TestStatsdMeterReportMode(t *testing.T) {
+	for mode, expected := range map[MeterReportMode][]string{
+		MeterReportBoth:  {"count", "one-minute", "five-minute", "fifteen-minute", "mean"},
+		MeterReportRates: {"one-minute", "five-minute", "fifteen-minute", "mean"},
+		MeterReportCount: {"count"},
+	} {
+		server := newStatsdTestServer(t)
+		r := NewRegistry()
+		NewRegisteredMeter("foo", r).Mark(1)
+		if err := NewStatsdReporter(StatsdConfig{
+			Addr:            server.Addr(),
+			Registry:        r,
+			FlushInterval:   time.Second,
+			Prefix:          "p",
+			MeterReportMode: mode,
+		}).flush(); nil != err {
+			t.Fatal(err)
+		}
+		lines := statsdLines(server.Packets())
+		server.Close()
+		if len(expected) != len(lines) {
+			t.Errorf("mode %d: %v", mode, lines)
+		}
+		for _, field := range expected {
+			found := false
+			for line := range lines {
+				if strings.HasPrefix(line, "p.foo."+field+":") {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("mode %d: p.foo.%s missing from %v", mode, field, lines)
+			}
+		}
+	}
+}
+
+func TestStatsdCaseFold(t *testing.T) {
+	for fold, expected := range map[CaseFold][]string{
+		CaseFoldNone:  {"App.HTTP.Requests.value:1|g", "App.http.requests.value:2|g"},
+		CaseFoldLower: {"app.http.requests.value:1|g", "app.http.requests.value:2|g"},
+		CaseFoldUpper: {"APP.HTTP.REQUESTS.value:1|g", "APP.HTTP.REQUESTS.value:2|g"},
+	} {
+		server := newStatsdTestServer(t)
+		r := NewRegistry()
+		NewRegisteredGauge("HTTP.Requests", r).Update(1)
+		NewRegisteredGauge("http.requests", r).Update(2)
+		if err := NewStatsdReporter(StatsdConfig{
+			Addr:          server.Addr(),
+			Registry:      r,
+			FlushInterval: time.Second,
+			Prefix:        "App",
+			CaseFold:      fold,
+		}).flush(); nil != err {
+			t.Fatal(err)
+		}
+		lines := statsdLines(server.Packets())
+		server.Close()
+		if len(expected) != len(lines) {
+			t.Errorf("fold %d: %v", fold, lines)
+		}
+		for _, line := range expected {
+			if !lines[line] {
+				t.Errorf("fold %d: %s missing from %v", fold, line, lines)
+			}
+		}
+	}
+}
+
+func TestStatsdRecoverPanic(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredTimer("bad", r).Update(time.Millisecond)
+	NewRegisteredGauge("good", r).Update(1)
+	var errs []error
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		DurationUnitFunc: func(name string) time.Duration {
+			panic("bad unit for " + name)
+		},
+		OnError: func(err error) { errs = append(errs, err) },
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(errs) || !strings.Contains(errs[0].Error(), "bad unit for bad") {
+		t.Fatal(errs)
+	}
+	if lines := statsdLines(server.Packets()); 1 != len(lines) || !lines["p.good.value:1|g"] {
+		t.Fatal(lines)
+	}
+}
+
+func TestStatsdReporterSetters(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredGauge("foo", r).Update(1)
+	clock := newFakeClock()
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		TagFormat:     TagFormatDatadog,
+		Clock:         clock,
+	})
+	ran := make(chan struct{})
+	go func() {
+		reporter.Run()
+		close(ran)
+	}()
+	defer func() {
+		reporter.Stop()
+		<-ran
+	}()
+	<-clock.created
+	clock.Advance(time.Second)
+	if packets := server.Packets(); 1 != len(packets) || "p.foo.value:1|g" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+	reporter.SetPrefix("q")
+	reporter.SetTags(map[string]string{"env": "prod"})
+	reporter.SetFlushInterval(time.Minute)
+	clock.Advance(time.Second)
+	if packets := server.Packets(); 1 != len(packets) || "q.foo.value:1|g|#env:prod" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+	<-clock.created
+	clock.Advance(time.Second)
+	if packets := server.Packets(); 0 != len(packets) {
+		t.Fatalf("%q", packets)
+	}
+	clock.Advance(time.Minute)
+	if packets := server.Packets(); 1 != len(packets) {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestStatsdMinFlushInterval(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	clock := newFakeClock()
+	errs := make(chan error, 2)
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:             server.Addr(),
+		Registry:         NewRegistry(),
+		FlushInterval:    time.Millisecond,
+		MinFlushInterval: time.Second,
+		Clock:            clock,
+		OnError:          func(err error) { errs <- err },
+	})
+	ran := make(chan struct{})
+	go func() {
+		reporter.Run()
+		close(ran)
+	}()
+	<-clock.created
+	reporter.SetMinFlushInterval(time.Minute)
+	clock.Advance(time.Second)
+	<-clock.created
+	reporter.Stop()
+	<-ran
+	clock.mutex.Lock()
+	var ds []time.Duration
+	for _, ticker := range clock.tickers {
+		ds = append(ds, ticker.d)
+	}
+	clock.mutex.Unlock()
+	if 2 != len(ds) || time.Second != ds[0] || time.Minute != ds[1] {
+		t.Fatal(ds)
+	}
+	close(errs)
+	var messages []string
+	for err := range errs {
+		if e, ok := err.(*StatsdError); !ok || StatsdErrorConfig != e.Category {
+			t.Fatal(err)
+		}
+		messages = append(messages, err.Error())
+	}
+	if "[statsd config: flush interval 1ms raised to the minimum of 1s statsd config: flush interval 1ms raised to the minimum of 1m0s]" != fmt.Sprint(messages) {
+		t.Fatalf("%q", messages)
+	}
+}
+
+func TestStatsdFlushOnStart(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredGauge("foo", r).Update(1)
+	clock := newFakeClock()
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Minute,
+		Prefix:        "p",
+		Clock:         clock,
+		FlushOnStart:  true,
+	})
+	ran := make(chan struct{})
+	go func() {
+		reporter.Run()
+		close(ran)
+	}()
+	defer func() {
+		reporter.Stop()
+		<-ran
+	}()
+	<-clock.created
+	if packets := server.Packets(); 1 != len(packets) || "p.foo.value:1|g" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestStatsdCoalesce(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r1, r2 := NewRegistry(), NewRegistry()
+	NewRegisteredGauge("foo", r1).Update(1)
+	NewRegisteredGauge("foo", r2).Update(2)
+	NewRegisteredCounter("bar", r1).Inc(3)
+	NewRegisteredCounter("bar", r2).Inc(4)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registries:    []Registry{r1, r2},
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		Coalesce:      true,
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	packets := server.Packets()
+	if 1 != len(packets) {
+		t.Fatalf("%q", packets)
+	}
+	lines := strings.Split(packets[0], "\n")
+	if 2 != len(lines) {
+		t.Fatalf("%q", lines)
+	}
+	if set := statsdLines(packets); !set["p.foo.value:2|g"] || !set["p.bar.count:7|c"] {
+		t.Fatal(set)
+	}
+}
+
+func TestStatsdBufferHighWater(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r, self := NewRegistry(), NewRegistry()
+	for i := 0; i < 10; i++ {
+		NewRegisteredGauge(fmt.Sprintf("foo%d", i), r).Update(1)
+	}
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		SelfRegistry:  self,
+		PacketSize:    64,
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	largest := 0
+	for _, packet := range server.Packets() {
+		if largest < len(packet) {
+			largest = len(packet)
+		}
+	}
+	if 0 == largest || 64 < largest {
+		t.Fatal(largest)
+	}
+	if highWater := self.Get("statsd.buffer.high-water").(Gauge).Value(); int64(largest) != highWater {
+		t.Fatal(highWater, largest)
+	}
+}
+
+func TestClientOversizedLine(t *testing.T) {
+	conn := &statsdTestConn{}
+	c := newClient(conn, 64)
+	long := strings.Repeat("x", 100)
+	if err := c.GaugeInt64("a", 1, 1); nil != err {
+		t.Fatal(err)
+	}
+	if err := c.GaugeInt64(long, 2, 1); nil != err {
+		t.Fatal(err)
+	}
+	if err := c.GaugeInt64("b", 3, 1); nil != err {
+		t.Fatal(err)
+	}
+	if err := c.Close(); nil != err {
+		t.Fatal(err)
+	}
+	packets := conn.Packets()
+	if 3 != len(packets) || "a:1|g" != packets[0] || long+":2|g" != packets[1] || "b:3|g" != packets[2] {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestClientFlushError(t *testing.T) {
+	conn := &bufferFullConn{failures: 1, err: errors.New("refused")}
+	c := newClient(conn, 64)
+	if err := c.GaugeInt64(strings.Repeat("x", 40), 1, 1); nil != err {
+		t.Fatal(err)
+	}
+	if err := c.GaugeInt64(strings.Repeat("y", 40), 2, 1); conn.err != err {
+		t.Fatal(err)
+	}
+}
+
+func TestStatsdNegativeCounters(t *testing.T) {
+	for policy, expected := range map[NegativeCounterPolicy][]string{
+		NegativeCounterSend:       {"p.foo.count:5|c", "p.foo.count:-8|c"},
+		NegativeCounterGaugeDelta: {"p.foo.count:+5|g", "p.foo.count:-8|g"},
+		NegativeCounterDrop:       {"p.foo.count:5|c"},
+	} {
+		server := newStatsdTestServer(t)
+		r := NewRegistry()
+		counter := NewRegisteredCounter("foo", r)
+		reporter := NewStatsdReporter(StatsdConfig{
+			Addr:             server.Addr(),
+			Registry:         r,
+			FlushInterval:    time.Second,
+			Prefix:           "p",
+			CounterDeltas:    true,
+			NegativeCounters: policy,
+		})
+		var packets []string
+		for _, delta := range []int64{5, -8} {
+			counter.Inc(delta)
+			if err := reporter.flush(); nil != err {
+				t.Fatal(err)
+			}
+			packets = append(packets, server.Packets()...)
+		}
+		server.Close()
+		if fmt.Sprint(expected) != fmt.Sprint(packets) {
+			t.Errorf("policy %d: %q", policy, packets)
+		}
+	}
+}
+
+func TestStatsdNegativeCounterReset(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r, self := NewRegistry(), NewRegistry()
+	counter := NewRegisteredCounter("foo", r)
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:             server.Addr(),
+		Registry:         r,
+		FlushInterval:    time.Second,
+		Prefix:           "p",
+		CounterDeltas:    true,
+		NegativeCounters: NegativeCounterReset,
+		SelfRegistry:     self,
+	})
+	var packets []string
+	for _, count := range []int64{100, 10, 15} {
+		counter.Clear()
+		counter.Inc(count)
+		if err := reporter.flush(); nil != err {
+			t.Fatal(err)
+		}
+		packets = append(packets, server.Packets()...)
+	}
+	if expected := []string{"p.foo.count:100|c", "p.foo.count:10|c", "p.foo.count:5|c"}; fmt.Sprint(expected) != fmt.Sprint(packets) {
+		t.Fatalf("%q", packets)
+	}
+	if count := self.Get("statsd.counter-resets").(Counter).Count(); 1 != count {
+		t.Fatal(count)
+	}
+}
+
+func TestStatsdResetCounters(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	counter := NewRegisteredCounter("foo", r)
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		ResetCounters: true,
+	})
+	for _, delta := range []int64{5, 3} {
+		counter.Inc(delta)
+		if err := reporter.flush(); nil != err {
+			t.Fatal(err)
+		}
+		if packets := server.Packets(); 1 != len(packets) || fmt.Sprintf("p.foo.count:%d|c", delta) != packets[0] {
+			t.Fatalf("%q", packets)
+		}
+		if count := counter.Count(); 0 != count {
+			t.Fatal(count)
+		}
+	}
+}
+
+func TestStatsdResetCountersFailedFlush(t *testing.T) {
+	r := NewRegistry()
+	counter := NewRegisteredCounter("foo", r)
+	var conns []*bufferFullConn
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:          "127.0.0.1:8125",
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		ResetCounters: true,
+		Dialer: func(network, addr string) (net.Conn, error) {
+			conn := &bufferFullConn{err: errors.New("refused")}
+			if 0 == len(conns) {
+				conn.failures = 1
+			}
+			conns = append(conns, conn)
+			return conn, nil
+		},
+	})
+	counter.Inc(5)
+	if err := reporter.flush(); nil == err {
+		t.Fatal(err)
+	}
+	if count := counter.Count(); 5 != count {
+		t.Fatal(count)
+	}
+	counter.Inc(3)
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+	if packets := conns[len(conns)-1].Packets(); 1 != len(packets) || "p.foo.count:8|c" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+	if count := counter.Count(); 0 != count {
+		t.Fatal(count)
+	}
+}
+
+func TestStatsdResetCountersAliases(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	counter := NewRegisteredCounter("new", r)
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		ResetCounters: true,
+		ChangedOnly:   true,
+		Aliases:       map[string]string{"new": "old"},
+	})
+	for _, delta := range []int64{5, 5} {
+		counter.Inc(delta)
+		if err := reporter.flush(); nil != err {
+			t.Fatal(err)
+		}
+		lines := statsdLines(server.Packets())
+		if 2 != len(lines) || !lines[fmt.Sprintf("p.new.count:%d|c", delta)] || !lines[fmt.Sprintf("p.old.count:%d|c", delta)] {
+			t.Fatal(lines)
+		}
+		if count := counter.Count(); 0 != count {
+			t.Fatal(count)
+		}
+	}
+}
+
+func TestStatsdReportSampleSize(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	small := NewRegisteredTimer("small", r)
+	full := NewCustomTimer(NewHistogram(NewUniformSample(4)), NewMeter())
+	r.Register("full", full)
+	for i := 0; i < 10; i++ {
+		full.Update(time.Millisecond)
+		if i < 3 {
+			small.Update(time.Millisecond)
+		}
+	}
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:             server.Addr(),
+		Registry:         r,
+		FlushInterval:    time.Second,
+		Prefix:           "p",
+		ReportSampleSize: true,
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	lines := statsdLines(server.Packets())
+	if !lines["p.small.sample-size:3|g"] || !lines["p.full.sample-size:4|g"] {
+		t.Fatal(lines)
+	}
+}
+
+func TestStatsdFlushEveryNMetrics(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	for i := 0; i < 5; i++ {
+		NewRegisteredGauge(fmt.Sprintf("foo%d", i), r).Update(1)
+	}
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:               server.Addr(),
+		Registry:           r,
+		FlushInterval:      time.Second,
+		Prefix:             "p",
+		FlushEveryNMetrics: 2,
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	packets := server.Packets()
+	if 3 != len(packets) {
+		t.Fatalf("%q", packets)
+	}
+	for i, packet := range packets {
+		if n := len(strings.Split(packet, "\n")); 2 < n || 2 > n && i < 2 {
+			t.Fatalf("%q", packets)
+		}
+	}
+}
+
+func TestSyncStatsd(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	g := NewRegisteredGauge("foo", r)
+	reporter := SyncStatsd(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+	})
+	for i := int64(1); i <= 2; i++ {
+		g.Update(i)
+		if err := reporter.Flush(); nil != err {
+			t.Fatal(err)
+		}
+		if packets := server.Packets(); 1 != len(packets) || fmt.Sprintf("p.foo.value:%d|g", i) != packets[0] {
+			t.Fatalf("%q", packets)
+		}
+	}
+	if packets := server.Packets(); 0 != len(packets) {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestSyncStatsdFlushCoalesceWindow(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredGauge("foo", r).Update(1)
+	clock := newFakeClock()
+	reporter := SyncStatsd(StatsdConfig{
+		Addr:                server.Addr(),
+		Registry:            r,
+		Prefix:              "p",
+		Clock:               clock,
+		FlushCoalesceWindow: time.Second,
+	})
+	for i := 0; i < 10; i++ {
+		if err := reporter.Flush(); nil != err {
+			t.Fatal(err)
+		}
+		clock.Advance(50 * time.Millisecond)
+	}
+	if packets := server.Packets(); 1 != len(packets) {
+		t.Fatalf("%q", packets)
+	}
+	clock.Advance(time.Second)
+	if err := reporter.Flush(); nil != err {
+		t.Fatal(err)
+	}
+	if packets := server.Packets(); 1 != len(packets) {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestStatsdInfo(t *testing.T) {
+	for format, expected := range map[TagFormat]string{
+		TagFormatNone:     "p.build.commit.abc.version.1_2_3.value:1|g",
+		TagFormatDatadog:  "p.build.value:1|g|#commit:abc,env:prod,version:1.2.3",
+		TagFormatGraphite: "p.build.value;commit=abc;env=prod;version=1.2.3:1|g",
+	} {
+		server := newStatsdTestServer(t)
+		r := NewRegistry()
+		RegisterInfo(r, "build", map[string]string{"version": "1.2.3", "commit": "abc"})
+		if err := NewStatsdReporter(StatsdConfig{
+			Addr:          server.Addr(),
+			Registry:      r,
+			FlushInterval: time.Second,
+			Prefix:        "p",
+			Tags:          map[string]string{"env": "prod"},
+			TagFormat:     format,
+		}).flush(); nil != err {
+			t.Fatal(err)
+		}
+		packets := server.Packets()
+		server.Close()
+		if 1 != len(packets) || expected != packets[0] {
+			t.Errorf("format %d: %q", format, packets)
+		}
+	}
+}
+
+func TestStatsdDNSCacheTTL(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Addr())
+	r := NewRegistry()
+	NewRegisteredGauge("foo", r).Update(1)
+	clock := newFakeClock()
+	lookups := 0
+	var lookupErr error
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:          net.JoinHostPort("statsd.example", port),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		Clock:         clock,
+		DNSCacheTTL:   time.Minute,
+		LookupHost: func(host string) ([]string, error) {
+			if "statsd.example" != host {
+				t.Fatal(host)
+			}
+			lookups++
+			return []string{"127.0.0.1"}, lookupErr
+		},
+	})
+	for i, expected := range []int{1, 1, 2, 3} {
+		switch i {
+		case 2:
+			clock.Advance(time.Minute)
+		case 3:
+			clock.Advance(time.Minute)
+			lookupErr = errors.New("lookup failed")
+		}
+		if err := reporter.flush(); nil != err {
+			t.Fatal(err)
+		}
+		if expected != lookups {
+			t.Fatal(i, lookups)
+		}
+		if packets := server.Packets(); 1 != len(packets) {
+			t.Fatalf("%d: %q", i, packets)
+		}
+	}
+}
+
+func TestStatsdClientDistribution(t *testing.T) {
+	conn := &statsdTestConn{}
+	c := newClient(conn, 0)
+	c.Distribution("foo", 1.5, 1)
+	c.Distribution("foo", 2, 1)
+	if err := c.Close(); nil != err {
+		t.Fatal(err)
+	}
+	if packets := conn.Packets(); 1 != len(packets) || "foo:1.5|d\nfoo:2|d" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestStatsdClientTimingDuration(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	sc, err := Dial(server.Addr())
+	if nil != err {
+		t.Fatal(err)
+	}
+	c, ok := sc.(TimingClient)
+	if !ok {
+		t.Fatalf("%T isn't a TimingClient", sc)
+	}
+	if err := c.TimingDuration("foo", 1500*time.Microsecond, 1); nil != err {
+		t.Fatal(err)
+	}
+	if err := c.TimeSince("bar", time.Now().Add(-time.Hour)); nil != err {
+		t.Fatal(err)
+	}
+	if err := c.Close(); nil != err {
+		t.Fatal(err)
+	}
+	packets := server.Packets()
+	if 1 != len(packets) {
+		t.Fatalf("%q", packets)
+	}
+	lines := strings.Split(packets[0], "\n")
+	if 2 != len(lines) || "foo:1.5|ms" != lines[0] || !strings.HasPrefix(lines[1], "bar:3600") || !strings.HasSuffix(lines[1], "|ms") {
+		t.Fatalf("%q", lines)
+	}
+}
+
+func TestStatsdTimerDistributions(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	timer := NewRegisteredDistributionTimer("foo", r, 10)
+	NewRegisteredTimer("bar", r).Update(time.Millisecond)
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:               server.Addr(),
+		Registry:           r,
+		FlushInterval:      time.Second,
+		DurationUnit:       time.Millisecond,
+		Prefix:             "p",
+		TagFormat:          TagFormatDatadog,
+		TimerDistributions: true,
+		Aliases:            map[string]string{"foo": "legacy"},
+	})
+	distributions := func() []string {
+		var lines []string
+		for _, packet := range server.Packets() {
+			for _, line := range strings.Split(packet, "\n") {
+				if strings.HasSuffix(line, "|d") {
+					lines = append(lines, line)
+				}
+			}
+		}
+		sort.Strings(lines)
+		return lines
+	}
+	timer.Update(5 * time.Millisecond)
+	timer.Update(6 * time.Millisecond)
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+	if lines := distributions(); "[p.foo:5|d p.foo:6|d p.legacy:5|d p.legacy:6|d]" != fmt.Sprint(lines) {
+		t.Fatal(lines)
+	}
+	timer.Update(time.Millisecond)
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+	if lines := distributions(); "[p.foo:1|d p.legacy:1|d]" != fmt.Sprint(lines) {
+		t.Fatal(lines)
+	}
+}
+
+func TestStatsdSampleRates(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredGauge("hot.foo", r).Update(1)
+	NewRegisteredGauge("hot.bar", r).Update(1)
+	NewRegisteredGauge("cold", r).Update(1)
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		SampleRates:   map[string]float64{"hot.": 0.5, "hot.bar": 0.25},
+	})
+	for i := 0; i < 50; i++ {
+		if err := reporter.flush(); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if lines := statsdLines(server.Packets()); 3 != len(lines) || !lines["p.hot.foo.value:1|g|@0.5"] || !lines["p.hot.bar.value:1|g|@0.25"] || !lines["p.cold.value:1|g"] {
+		t.Fatal(lines)
+	}
+}
+
+func TestStatsdSampledOut(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r, self := NewRegistry(), NewRegistry()
+	NewRegisteredGauge("foo", r).Update(1)
+	NewRegisteredGauge("bar", r).Update(1)
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		SampleRates:   map[string]float64{"": 0},
+		SelfRegistry:  self,
+	})
+	for i := 0; i < 5; i++ {
+		if err := reporter.flush(); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if lines := statsdLines(server.Packets()); 0 != len(lines) {
+		t.Fatal(lines)
+	}
+	if count := self.Get("statsd.sampled-out").(Counter).Count(); 10 != count {
+		t.Fatal(count)
+	}
+}
+
+func TestStatsdConcurrentRegistration(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredGauge("foo", r).Update(1)
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		DurationUnitFunc: func(name string) time.Duration {
+			GetOrRegisterCounter(name+".units", r).Inc(1)
+			return time.Millisecond
+		},
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			GetOrRegisterTimer(fmt.Sprintf("bar%d", i), r).Update(time.Millisecond)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if err := reporter.flush(); nil != err {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	server.Packets()
+}
+
+func TestStatsdTargets(t *testing.T) {
+	vanilla, datadog := newStatsdTestServer(t), newStatsdTestServer(t)
+	defer vanilla.Close()
+	defer datadog.Close()
+	r := NewRegistry()
+	NewRegisteredCounter("foo", r).Inc(3)
+	if err := NewStatsdReporter(StatsdConfig{
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		Tags:          map[string]string{"env": "prod"},
+		Targets: []StatsdTarget{
+			{Addr: vanilla.Addr(), TagFormat: TagFormatNone},
+			{Addr: datadog.Addr(), TagFormat: TagFormatDatadog},
+		},
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	if packets := vanilla.Packets(); 1 != len(packets) || "p.foo.count:3|c" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+	if packets := datadog.Packets(); 1 != len(packets) || "p.foo.count:3|c|#env:prod" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestStatsdTargetsUnreachable(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	NewRegisteredGauge("foo", r).Update(1)
+	err := NewStatsdReporter(StatsdConfig{
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		Targets: []StatsdTarget{
+			{Addr: "localhost:statsd-port-that-does-not-exist"},
+			{Addr: server.Addr()},
+		},
+	}).flush()
+	if nil == err {
+		t.Fatal(err)
+	}
+	if packets := server.Packets(); 1 != len(packets) || "p.foo.value:1|g" != packets[0] {
+		t.Fatalf("%q", packets)
+	}
+}
+
+func TestStatsdGaugeClamping(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r, self := NewRegistry(), NewRegistry()
+	NewRegisteredGauge("high", r).Update(1000)
+	NewRegisteredGauge("ok", r).Update(50)
+	NewRegisteredGaugeFloat64("low", r).Update(-1.5)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		SelfRegistry:  self,
+		GaugeMin:      0,
+		GaugeMax:      100,
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	lines := statsdLines(server.Packets())
+	if !lines["p.high.value:100|g"] || !lines["p.ok.value:50|g"] || !lines["p.low.value:0|g"] {
+		t.Fatal(lines)
+	}
+	if clamped := self.Get("statsd.clamped").(Counter).Count(); 2 != clamped {
+		t.Fatal(clamped)
+	}
+}
+
+func TestStatsdEmitRegistrySize(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r1, r2 := NewRegistry(), NewRegistry()
+	NewRegisteredGauge("foo", r1).Update(1)
+	NewRegisteredCounter("bar", r1).Inc(1)
+	NewRegisteredTimer("baz", r2)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:             server.Addr(),
+		Registry:         r1,
+		Registries:       []Registry{r2},
+		FlushInterval:    time.Second,
+		Prefix:           "p",
+		EmitRegistrySize: true,
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	if lines := statsdLines(server.Packets()); !lines["p.registry.size:3|g"] {
+		t.Fatal(lines)
+	}
+}
+
+func TestStatsdBeforeFlush(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	g := NewRegisteredGauge("cache.size", r)
+	size := int64(0)
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:          server.Addr(),
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		BeforeFlush: func(registry Registry) {
+			if r != registry {
+				t.Fatal(registry)
+			}
+			size += 10
+			g.Update(size)
+		},
+	})
+	for _, expected := range []string{"p.cache.size.value:10|g", "p.cache.size.value:20|g"} {
+		if err := reporter.flush(); nil != err {
+			t.Fatal(err)
+		}
+		if packets := server.Packets(); 1 != len(packets) || expected != packets[0] {
+			t.Fatalf("%q", packets)
+		}
+	}
+}
+
+func TestStatsdReportTimerCountRate(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	timer := NewRegisteredTimer("foo", r)
+	clock := newFakeClock()
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:                 server.Addr(),
+		Registry:             r,
+		FlushInterval:        time.Second,
+		Prefix:               "p",
+		Clock:                clock,
+		ReportTimerCountRate: true,
+	})
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+	for line := range statsdLines(server.Packets()) {
+		if strings.HasPrefix(line, "p.foo.count-rate:") {
+			t.Fatal(line)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		timer.Update(time.Millisecond)
+	}
+	clock.Advance(2 * time.Second)
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+	if lines := statsdLines(server.Packets()); !lines["p.foo.count-rate:100|g"] {
+		t.Fatal(lines)
+	}
+}
+
+func TestStatsdFloatFormat(t *testing.T) {
+	for format, expected := range map[byte][]string{
+		0:   {"p.tiny.value:0.000000001|g", "p.huge.value:1000000000000|g"},
+		'g': {"p.tiny.value:1e-09|g", "p.huge.value:1e+12|g"},
+		'e': {"p.tiny.value:1e-09|g", "p.huge.value:1e+12|g"},
+	} {
+		server := newStatsdTestServer(t)
+		r := NewRegistry()
+		NewRegisteredGaugeFloat64("tiny", r).Update(1e-9)
+		NewRegisteredGaugeFloat64("huge", r).Update(1e12)
+		if err := NewStatsdReporter(StatsdConfig{
+			Addr:          server.Addr(),
+			Registry:      r,
+			FlushInterval: time.Second,
+			Prefix:        "p",
+			FloatFormat:   format,
+		}).flush(); nil != err {
+			t.Fatal(err)
+		}
+		lines := statsdLines(server.Packets())
+		server.Close()
+		for _, line := range expected {
+			if !lines[line] {
+				t.Errorf("format %q: %s missing from %v", format, line, lines)
+			}
+		}
+	}
+}
+
+func TestStatsdReportCounterRate(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	counter := NewRegisteredCounter("foo", r)
+	clock := newFakeClock()
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:              server.Addr(),
+		Registry:          r,
+		FlushInterval:     2 * time.Second,
+		Prefix:            "p",
+		Clock:             clock,
+		ReportCounterRate: true,
+	})
+	for _, step := range []struct {
+		inc     int64
+		advance time.Duration
+		lines   []string
+	}{
+		{10, 0, []string{"p.foo.count:10|c", "p.foo.rate:5|g"}},
+		{30, 3 * time.Second, []string{"p.foo.count:40|c", "p.foo.rate:10|g"}},
+	} {
+		counter.Inc(step.inc)
+		clock.Advance(step.advance)
+		if err := reporter.flush(); nil != err {
+			t.Fatal(err)
+		}
+		lines := statsdLines(server.Packets())
+		for _, line := range step.lines {
+			if !lines[line] {
+				t.Fatal(lines)
+			}
+		}
+	}
+}
+
+func TestStatsdNoTrailingDelimiter(t *testing.T) {
+	conn := &statsdTestConn{}
+	c := newClient(conn, 0)
+	c.Increment("foo", 1, 1)
+	c.Flush()
+	c.Increment("foo", 1, 1)
+	c.Increment("bar", 2, 1)
+	c.Flush()
+	fmt.Fprint(c.buf, "baz:3|c\n\n")
+	c.Flush()
+	fmt.Fprint(c.buf, "\n")
+	if err := c.Close(); nil != err {
+		t.Fatal(err)
+	}
+	packets := conn.Packets()
+	if "[foo:1|c foo:1|c\nbar:2|c baz:3|c]" != fmt.Sprint(packets) {
+		t.Fatalf("%q", packets)
+	}
+}
+
+// keepAliveConn records the keepalive settings applied to it.
+type keepAliveConn struct {
+	statsdTestConn
+	keepAlive bool
+	period    time.Duration
+}
+
+func (c *keepAliveConn) SetKeepAlive(keepAlive bool) error {
+	c.keepAlive = keepAlive
+	return nil
+}
+
+func (c *keepAliveConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.period = d
+	return nil
+}
+
+func TestSetKeepAlive(t *testing.T) {
+	conn := &keepAliveConn{}
+	if err := setKeepAlive(conn, time.Minute); nil != err {
+		t.Fatal(err)
+	}
+	if !conn.keepAlive || time.Minute != conn.period {
+		t.Fatal(conn.keepAlive, conn.period)
+	}
+	if err := setKeepAlive(&statsdTestConn{}, time.Minute); nil != err {
+		t.Fatal(err)
+	}
+}
+
+type writeBufferConn struct {
+	statsdTestConn
+	bytes int
+}
+
+func (c *writeBufferConn) SetWriteBuffer(bytes int) error {
+	c.bytes = bytes
+	return nil
+}
+
+func TestSetWriteBuffer(t *testing.T) {
+	conn := &writeBufferConn{}
+	if err := setWriteBuffer(conn, 1<<20); nil != err {
+		t.Fatal(err)
+	}
+	if 1<<20 != conn.bytes {
+		t.Fatal(conn.bytes)
+	}
+	if err := setWriteBuffer(&statsdTestConn{}, 1<<20); nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestStatsdSocketSendBufferBytes(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	c := StatsdConfig{Addr: server.Addr(), SocketSendBufferBytes: 1 << 20}
+	s, err := c.dial()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, ok := s.conn.(*net.UDPConn); !ok {
+		t.Fatalf("%T", s.conn)
+	}
+}
+
+func TestStatsdTCPKeepAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c := StatsdConfig{Addr: l.Addr().String(), Transport: "tcp", TCPKeepAlive: time.Minute}
+	s, err := c.dial()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, ok := s.conn.(*net.TCPConn); !ok {
+		t.Fatalf("%T", s.conn)
+	}
+}
+
+func TestStatsdUnixStream(t *testing.T) {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "statsd.sock"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan []string)
+	go func() {
+		conn, err := l.Accept()
+		if nil != err {
+			close(lines)
+			return
+		}
+		defer conn.Close()
+		var ls []string
+		for s := bufio.NewScanner(conn); s.Scan(); {
+			ls = append(ls, s.Text())
+		}
+		lines <- ls
+	}()
+	r := NewRegistry()
+	for i := 0; i < 20; i++ {
+		NewRegisteredGauge(fmt.Sprintf("foo%d", i), r).Update(int64(i))
+	}
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:          l.Addr().String(),
+		Transport:     "unix",
+		Registry:      r,
+		FlushInterval: time.Second,
+		Prefix:        "p",
+		PacketSize:    64,
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	ls := <-lines
+	if 20 != len(ls) {
+		t.Fatalf("%q", ls)
+	}
+	for _, line := range ls {
+		var i int
+		if _, err := fmt.Sscanf(line, "p.foo%d.value:", &i); nil != err || fmt.Sprintf("p.foo%d.value:%d|g", i, i) != line {
+			t.Errorf("%q", line)
+		}
+	}
+}
+
+func TestStatsdDialer(t *testing.T) {
+	var network, addr string
+	conn := &statsdTestConn{}
+	c := StatsdConfig{
+		Addr:      "statsd.example.com:8125",
+		Transport: "tcp",
+		Dialer: func(n, a string) (net.Conn, error) {
+			network, addr = n, a
+			return conn, nil
+		},
+	}
+	s, err := c.dial()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if "tcp" != network || "statsd.example.com:8125" != addr {
+		t.Fatal(network, addr)
+	}
+	if conn != s.conn {
+		t.Fatalf("%T", s.conn)
+	}
+}
+
+func TestStatsdDialRetryBackoff(t *testing.T) {
+	clock := newFakeClock()
+	attempts := 0
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:          "statsd:8125",
+		Registry:      NewRegistry(),
+		FlushInterval: time.Second,
+		Clock:         clock,
+		DialRetries:   3,
+		Dialer: func(network, addr string) (net.Conn, error) {
+			attempts++
+			return nil, errors.New("connection refused")
+		},
+	})
+	errs := make(chan error)
+	go func() { errs <- reporter.flush() }()
+	for _, backoff := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+	} {
+		<-clock.created
+		clock.mutex.Lock()
+		d := clock.tickers[len(clock.tickers)-1].d
+		clock.mutex.Unlock()
+		if backoff != d {
+			t.Fatalf("%v != %v", backoff, d)
+		}
+		clock.Advance(d)
+	}
+	if err := <-errs; nil == err {
+		t.Fatal("flush succeeded")
+	}
+	if 4 != attempts {
+		t.Fatal(attempts)
+	}
+}
+
+func TestStatsdDialRetries(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	attempts := 0
+	r := NewRegistry()
+	NewRegisteredCounter("foo", r).Inc(1)
+	if err := NewStatsdReporter(StatsdConfig{
+		Addr:             addr,
+		Transport:        "tcp",
+		Registry:         r,
+		FlushInterval:    time.Second,
+		Prefix:           "p",
+		DialRetries:      3,
+		DialRetryBackoff: time.Millisecond,
+		Dialer: func(network, addr string) (net.Conn, error) {
+			attempts++
+			conn, err := net.Dial(network, addr)
+			if 1 == attempts {
+				if nil == err {
+					conn.Close()
+					t.Fatal("dialed before listening")
+				}
+
+				// The server comes up only once the first dial has failed.
+				var listenErr error
+				if l, listenErr = net.Listen(network, addr); nil != listenErr {
+					t.Fatal(listenErr)
+				}
+			}
+			return conn, err
+		},
+	}).flush(); nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if 2 != attempts {
+		t.Fatal(attempts)
+	}
+	conn, err := l.Accept()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "p.foo.count:1|c\n" != line {
+		t.Fatalf("%q", line)
+	}
+}
+
+func TestStatsdAliases(t *testing.T) {
+	for only, expected := range map[bool][]string{
+		false: {"p.new.name.count:1|c", "p.old.name.count:1|c"},
+		true:  {"p.old.name.count:1|c"},
+	} {
+		server := newStatsdTestServer(t)
+		r := NewRegistry()
+		NewRegisteredCounter("new.name", r).Inc(1)
+		if err := NewStatsdReporter(StatsdConfig{
+			Addr:          server.Addr(),
+			Registry:      r,
+			FlushInterval: time.Second,
+			Prefix:        "p",
+			Aliases:       map[string]string{"new.name": "old.name"},
+			AliasesOnly:   only,
+		}).flush(); nil != err {
+			t.Fatal(err)
+		}
+		lines := statsdLines(server.Packets())
+		server.Close()
+		if len(expected) != len(lines) {
+			t.Errorf("AliasesOnly %v: %v", only, lines)
+		}
+		for _, line := range expected {
+			if !lines[line] {
+				t.Errorf("AliasesOnly %v: %v", only, lines)
+			}
+		}
+	}
+}
+
+func TestStatsdGaugeDeadband(t *testing.T) {
+	for _, test := range []struct {
+		deadband float64
+		percent  bool
+		values   []int64
+		expected []string
+	}{
+		{5, false, []int64{100, 103, 98, 96, 106}, []string{"p.foo.value:100|g", "p.foo.value:106|g"}},
+		{50, true, []int64{10, 13, 8, 6, 16}, []string{"p.foo.value:10|g", "p.foo.value:16|g"}},
+	} {
+		server := newStatsdTestServer(t)
+		r := NewRegistry()
+		gauge := NewRegisteredGauge("foo", r)
+		reporter := NewStatsdReporter(StatsdConfig{
+			Addr:                 server.Addr(),
+			Registry:             r,
+			FlushInterval:        time.Second,
+			Prefix:               "p",
+			GaugeDeadband:        test.deadband,
+			GaugeDeadbandPercent: test.percent,
+		})
+		var packets []string
+		for _, v := range test.values {
+			gauge.Update(v)
+			if err := reporter.flush(); nil != err {
+				t.Fatal(err)
+			}
+			packets = append(packets, server.Packets()...)
+		}
+		server.Close()
+		if fmt.Sprint(test.expected) != fmt.Sprint(packets) {
+			t.Errorf("GaugeDeadbandPercent %v: %q", test.percent, packets)
+		}
+	}
+}
+
+func TestStatsdGaugeSmoothingAlpha(t *testing.T) {
+	server := newStatsdTestServer(t)
+	defer server.Close()
+	r := NewRegistry()
+	gauge := NewRegisteredGauge("foo", r)
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:                server.Addr(),
+		Registry:            r,
+		FlushInterval:       time.Second,
+		Prefix:              "p",
+		GaugeSmoothingAlpha: 0.5,
+	})
+	var packets []string
+	for _, v := range []int64{0, 100, 100, 100} {
+		gauge.Update(v)
+		if err := reporter.flush(); nil != err {
+			t.Fatal(err)
+		}
+		packets = append(packets, server.Packets()...)
+	}
+	expected := []string{"p.foo.value:0|g", "p.foo.value:50|g", "p.foo.value:75|g", "p.foo.value:87.5|g"}
+	if fmt.Sprint(expected) != fmt.Sprint(packets) {
+		t.Fatalf("%q", packets)
+	}
+}
+
+// BenchmarkStatsdCounters flushes 10,000 counters as totals, which take the
+// fast path, and as deltas, which don't.
+func BenchmarkStatsdCounters(b *testing.B) {
+	r := NewRegistry()
+	for i := 0; i < 10000; i++ {
+		NewRegisteredCounter(fmt.Sprintf("counter%d", i), r).Inc(1)
+	}
+	for _, deltas := range []bool{false, true} {
+		b.Run(fmt.Sprintf("deltas=%v", deltas), func(b *testing.B) {
+			reporter := NewStatsdReporter(StatsdConfig{
+				Registry:      r,
+				FlushInterval: time.Second,
+				Prefix:        "p",
+				CounterDeltas: deltas,
+				Dialer: func(network, addr string) (net.Conn, error) {
+					return discardConn{}, nil
+				},
+			})
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := reporter.flush(); nil != err {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestStatsdValidateOnDial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if nil != err {
+			return
+		}
+		conn.Close()
+	}()
+	c := StatsdConfig{Addr: l.Addr().String(), Transport: "tcp", ValidateOnDial: true}
+	if s, err := c.dial(); nil == err {
+		s.Close()
+		t.Fatal("dial validated a closed connection")
+	}
+}
+
+func TestStatsdValidateOnDialOpen(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if nil != err {
+			return
+		}
+		accepted <- conn
+	}()
+	c := StatsdConfig{Addr: l.Addr().String(), Transport: "tcp", ValidateOnDial: true}
+	s, err := c.dial()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	(<-accepted).Close()
+}
+
+func TestStatsdValidateOnDialOnce(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		first, err := l.Accept()
+		if nil != err {
+			return
+		}
+		defer first.Close()
+		for {
+			conn, err := l.Accept()
+			if nil != err {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	r := NewRegistry()
+	NewRegisteredGauge("foo", r).Update(1)
+	reporter := NewStatsdReporter(StatsdConfig{
+		Addr:           l.Addr().String(),
+		Registry:       r,
+		FlushInterval:  time.Second,
+		Prefix:         "p",
+		Transport:      "tcp",
+		ValidateOnDial: true,
+	})
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+
+	// The server now hangs up on every connection, which validation would
+	// catch, but the target's already been validated.
+	if err := reporter.flush(); nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestDurationUnitName(t *testing.T) {
+	for d, name := range map[time.Duration]string{
+		time.Millisecond:        "ms",
+		time.Hour:               "h",
+		1500 * time.Microsecond: "1_5ms",
+		1500 * time.Nanosecond:  "1_5us",
+		10 * time.Millisecond:   "10ms",
+		90 * time.Minute:        "1h30m0s",
+	} {
+		if s := durationUnitName(d); name != s {
+			t.Errorf("%v: %q != %q", d, s, name)
+		}
+	}
+}
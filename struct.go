@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// structMetricTypes maps the types named in metric struct tags to the
+// metric interfaces fields of those types must have and their constructors.
+var structMetricTypes = map[string]struct {
+	field reflect.Type
+	new   func() interface{}
+}{
+	"counter":      {reflect.TypeOf((*Counter)(nil)).Elem(), func() interface{} { return NewCounter() }},
+	"gauge":        {reflect.TypeOf((*Gauge)(nil)).Elem(), func() interface{} { return NewGauge() }},
+	"gaugefloat64": {reflect.TypeOf((*GaugeFloat64)(nil)).Elem(), func() interface{} { return NewGaugeFloat64() }},
+	"meter":        {reflect.TypeOf((*Meter)(nil)).Elem(), func() interface{} { return NewMeter() }},
+	"timer":        {reflect.TypeOf((*Timer)(nil)).Elem(), func() interface{} { return NewTimer() }},
+}
+
+// RegisterStruct constructs a metric for each field of the struct s points
+// to that's tagged `metric:"name,type"`, registers it under name, joined to
+// prefix by a dot unless prefix is empty, and stores it in that field.  The
+// type is one of counter, gauge, gaugefloat64, meter or timer and must match
+// the field's type, Counter for counter and so on; if it's left out, it's
+// taken from the field's type.  Nothing is registered if any tagged field
+// is unsupported and registration stops at the first error from r.
+func RegisterStruct(r Registry, prefix string, s interface{}) error {
+	if nil == r {
+		r = DefaultRegistry
+	}
+	v := reflect.ValueOf(s)
+	if reflect.Ptr != v.Kind() || reflect.Struct != v.Elem().Kind() {
+		return fmt.Errorf("metrics: RegisterStruct of %T, not a pointer to a struct", s)
+	}
+	v = v.Elem()
+	type field struct {
+		name  string
+		value reflect.Value
+		new   func() interface{}
+	}
+	var fields []field
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		tag, ok := f.Tag.Lookup("metric")
+		if !ok {
+			continue
+		}
+		name, kind := tag, ""
+		if idx := strings.Index(tag, ","); -1 != idx {
+			name, kind = tag[:idx], tag[idx+1:]
+		}
+		if "" == name {
+			name = f.Name
+		}
+		if "" == kind {
+			for k, t := range structMetricTypes {
+				if t.field == f.Type {
+					kind = k
+				}
+			}
+		}
+		t, ok := structMetricTypes[kind]
+		if !ok || t.field != f.Type || "" != f.PkgPath {
+			return fmt.Errorf("metrics: unsupported metric field %s %v `metric:%q`", f.Name, f.Type, tag)
+		}
+		if "" != prefix {
+			name = prefix + "." + name
+		}
+		fields = append(fields, field{name, v.Field(i), t.new})
+	}
+	for _, f := range fields {
+		m := f.new()
+		if err := r.Register(f.name, m); nil != err {
+			return err
+		}
+		f.value.Set(reflect.ValueOf(m))
+	}
+	return nil
+}
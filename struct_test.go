@@ -0,0 +1,60 @@
+package metrics
+
+import "testing"
+
+func TestRegisterStruct(t *testing.T) {
+	var s struct {
+		Requests Counter `metric:"requests,counter"`
+		Sessions Gauge   `metric:"sessions"`
+		Latency  Timer   `metric:",timer"`
+		Ignored  Counter
+	}
+	r := NewRegistry()
+	if err := RegisterStruct(r, "app", &s); nil != err {
+		t.Fatal(err)
+	}
+	s.Requests.Inc(1)
+	s.Sessions.Update(2)
+	if c, ok := r.Get("app.requests").(Counter); !ok || 1 != c.Count() {
+		t.Fatal(r.Get("app.requests"))
+	}
+	if g, ok := r.Get("app.sessions").(Gauge); !ok || 2 != g.Value() {
+		t.Fatal(r.Get("app.sessions"))
+	}
+	if _, ok := r.Get("app.Latency").(Timer); !ok {
+		t.Fatal(r.Get("app.Latency"))
+	}
+	if nil != s.Ignored {
+		t.Fatal(s.Ignored)
+	}
+	n := 0
+	r.Each(func(string, interface{}) { n++ })
+	if 3 != n {
+		t.Fatal(n)
+	}
+}
+
+func TestRegisterStructUnsupported(t *testing.T) {
+	r := NewRegistry()
+	for _, s := range []interface{}{
+		&struct {
+			Requests Counter `metric:"requests,gauge"`
+		}{},
+		&struct {
+			Requests int64 `metric:"requests"`
+		}{},
+		&struct {
+			Requests Counter `metric:"requests,histogram"`
+		}{},
+		struct{}{},
+	} {
+		if err := RegisterStruct(r, "", s); nil == err {
+			t.Errorf("%T registered", s)
+		}
+	}
+	n := 0
+	r.Each(func(string, interface{}) { n++ })
+	if 0 != n {
+		t.Fatal(n)
+	}
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// DistributionTimers are Timers which also keep the value of every event
+// timed since their values were last taken, up to a bound, so exporters can
+// send each event's value rather than the values in a decaying sample.
+type DistributionTimer struct {
+	Timer
+	mutex    sync.Mutex
+	values   []int64
+	start, n int
+}
+
+// NewDistributionTimer constructs a new DistributionTimer keeping up to size
+// values, dropping the oldest once it's full.
+func NewDistributionTimer(size int) *DistributionTimer {
+	return &DistributionTimer{Timer: NewTimer(), values: make([]int64, size)}
+}
+
+// NewRegisteredDistributionTimer constructs and registers a new
+// DistributionTimer.
+func NewRegisteredDistributionTimer(name string, r Registry, size int) *DistributionTimer {
+	t := NewDistributionTimer(size)
+	if nil == r {
+		r = DefaultRegistry
+	}
+	r.Register(name, t)
+	return t
+}
+
+// TakeValues returns the values of the events timed since it was last
+// called, oldest first, and forgets them.
+func (t *DistributionTimer) TakeValues() []int64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	values := make([]int64, t.n)
+	for i := range values {
+		values[i] = t.values[(t.start+i)%len(t.values)]
+	}
+	t.start, t.n = 0, 0
+	return values
+}
+
+// Time records the duration of the execution of the given function.
+func (t *DistributionTimer) Time(f func()) {
+	ts := time.Now()
+	f()
+	t.Update(time.Since(ts))
+}
+
+// Update records the duration of an event.
+func (t *DistributionTimer) Update(d time.Duration) {
+	t.Timer.Update(d)
+	t.record(int64(d))
+}
+
+// UpdateSince records the duration of an event that started at a time and
+// ends now.
+func (t *DistributionTimer) UpdateSince(ts time.Time) {
+	t.Update(time.Since(ts))
+}
+
+// record keeps the value v, dropping the oldest kept if there's no room.
+func (t *DistributionTimer) record(v int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if 0 == len(t.values) {
+		return
+	}
+	if len(t.values) == t.n {
+		t.start = (t.start + 1) % len(t.values)
+		t.n--
+	}
+	t.values[(t.start+t.n)%len(t.values)] = v
+	t.n++
+}
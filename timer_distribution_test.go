@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDistributionTimer(t *testing.T) {
+	timer := NewDistributionTimer(2)
+	timer.Update(3)
+	timer.Update(1)
+	if values := timer.TakeValues(); "[3 1]" != fmt.Sprint(values) {
+		t.Fatal(values)
+	}
+	if values := timer.TakeValues(); 0 != len(values) {
+		t.Fatal(values)
+	}
+	timer.Update(5)
+	timer.Update(4)
+	timer.Time(func() {})
+	if values := timer.TakeValues(); 2 != len(values) || 4 != values[0] {
+		t.Fatal(values)
+	}
+	if count := timer.Count(); 5 != count {
+		t.Fatal(count)
+	}
+}
+
+func TestDistributionTimerUpdateSince(t *testing.T) {
+	timer := NewDistributionTimer(1)
+	timer.UpdateSince(time.Now().Add(-time.Second))
+	if values := timer.TakeValues(); 1 != len(values) || values[0] < int64(time.Second) {
+		t.Fatal(values)
+	}
+}